@@ -54,6 +54,38 @@ app.kubernetes.io/instance: {{ .Release.Name }}
 Expand the name of the tls-secret.
 */}}
 {{- define "statefulset-affinity-injector.tls-secret-name" -}}
+{{- if .Values.tls.existingSecret }}
+{{- .Values.tls.existingSecret }}
+{{- else }}
 {{- $base := include "statefulset-affinity-injector.name" . -}}
 {{- printf "%s-tls-secrets" $base }}
 {{- end }}
+{{- end }}
+
+{{/*
+CA bundle the API server verifies the webhook certificate with. Without a
+certificate in the values it has to be given explicitly.
+*/}}
+{{- define "statefulset-affinity-injector.caBundle" -}}
+{{- if .Values.tls.existingSecret }}
+{{- required "tls.caBundle is required with tls.existingSecret" .Values.tls.caBundle | b64enc | quote }}
+{{- else }}
+{{- .Values.tls.caBundle | default .Values.tls.cert | b64enc | quote }}
+{{- end }}
+{{- end }}
+
+{{/*
+Object selector of the webhooks. With label opt-in the enabled label is
+added to the configured selector, so the API server filters objects before
+calling the webhook.
+*/}}
+{{- define "statefulset-affinity-injector.objectSelector" -}}
+{{- $selector := deepCopy .Values.webhook.objectSelector }}
+{{- if eq .Values.webhook.optIn "label" }}
+{{- $requirement := dict "key" (printf "%s/enabled" .Values.annotationDomain) "operator" "In" "values" (list "true") }}
+{{- $_ := set $selector "matchExpressions" (append (default (list) $selector.matchExpressions) $requirement) }}
+{{- end }}
+{{- with $selector }}
+{{- toYaml . }}
+{{- end }}
+{{- end }}
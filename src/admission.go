@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	failurePolicyFail   = "Fail"
+	failurePolicyIgnore = "Ignore"
+
+	// the api server waits this long when the webhook sets no timeoutSeconds
+	defaultAdmissionTimeout = 10 * time.Second
+)
+
+// admissionReviewVersions are the AdmissionReview versions the webhook
+// accepts. Both versions have the same fields, so reviews of either version
+// are decoded into the v1 types, and the response keeps the apiVersion of the
+// request as the api server expects.
+var admissionReviewVersions = []string{
+	admissionv1.SchemeGroupVersion.String(),
+	"admission.k8s.io/v1beta1",
+}
+
+// Admission is an admission request on its way through a mutator. Mutators
+// may add fields to the logger, it is used to log the response.
+type Admission struct {
+	Request      *admissionv1.AdmissionRequest
+	Logger       *slog.Logger
+	ServerConfig *ServerConfig
+	// HandlerName is the handler label of the metrics about the request
+	HandlerName string
+}
+
+type admitFunc func(ctx context.Context, admission *Admission) (*admissionv1.AdmissionResponse, error)
+
+type admissionResult struct {
+	response *admissionv1.AdmissionResponse
+	err      error
+	reason   string
+}
+
+// getAdmissionDeadline returns how long a mutator may take. The api server
+// passes the timeoutSeconds of the webhook as the timeout query parameter,
+// and a fifth of it is left for the response to reach the api server.
+func getAdmissionDeadline(r *http.Request) time.Duration {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 {
+		timeout = defaultAdmissionTimeout
+	}
+	return timeout * 4 / 5
+}
+
+func checkAdmissionReview(admissionReview *admissionv1.AdmissionReview) error {
+	if !slices.Contains(admissionReviewVersions, admissionReview.APIVersion) || admissionReview.Kind != "AdmissionReview" {
+		return fmt.Errorf("Expected an AdmissionReview of version %v, got %s %s", admissionReviewVersions, admissionReview.APIVersion, admissionReview.Kind)
+	}
+
+	if admissionReview.Request == nil {
+		return fmt.Errorf("Admission review has no request")
+	}
+
+	return nil
+}
+
+// getFailureAdmissionResponse answers a request the webhook failed to handle
+// the way the api server would with the failure policy of the webhook
+func getFailureAdmissionResponse(admissionRequest *admissionv1.AdmissionRequest, err error, failurePolicy string) *admissionv1.AdmissionResponse {
+	if failurePolicy == failurePolicyIgnore {
+		admissionResponse := getAllowedAdmissionResponse(admissionRequest)
+		admissionResponse.Warnings = []string{fmt.Sprintf("Affinity was not injected: %v", err)}
+		return admissionResponse
+	}
+
+	return &admissionv1.AdmissionResponse{
+		UID:     admissionRequest.UID,
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusInternalServerError,
+			Reason:  metav1.StatusReasonInternalError,
+			Message: err.Error(),
+		},
+	}
+}
+
+// runAdmission runs admit with panic recovery and gives up once ctx is done.
+// A mutator that is given up on keeps running, but its result is dropped, so
+// mutators check ctx before they log, count or record anything.
+func runAdmission(ctx context.Context, admit admitFunc, admission *Admission) admissionResult {
+	results := make(chan admissionResult, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				slog.Error("Recovered from panic while handling admission request", "uid", admission.Request.UID, "panic", recovered, "stack", string(debug.Stack()))
+				results <- admissionResult{err: fmt.Errorf("Internal error while handling admission request: %v", recovered), reason: "panic"}
+			}
+		}()
+
+		response, err := admit(ctx, admission)
+		if err == nil && response == nil {
+			err = fmt.Errorf("Mutator returned no response")
+		}
+
+		reason := "error"
+		var patchVerificationError *PatchVerificationError
+		if errors.As(err, &patchVerificationError) {
+			reason = "verification"
+		}
+		results <- admissionResult{response: response, err: err, reason: reason}
+	}()
+
+	select {
+	case result := <-results:
+		return result
+	case <-ctx.Done():
+		return admissionResult{err: fmt.Errorf("Could not handle admission request in time: %v", ctx.Err()), reason: "timeout"}
+	}
+}
+
+// serveAdmission is the pipeline shared by every mutator. It checks and
+// decodes the admission review, skips excluded namespaces and answers
+// according to the failure policy when the mutator of the request fails,
+// panics or runs out of time, so the api server always gets a well-formed
+// response. Requests are counted under the handler name of their mutator,
+// or under handlerName if their kind has none.
+func serveAdmission(handlerName string, registry *MutatorRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serverConfig := getServerConfig()
+		ctx := r.Context()
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			slog.Error("Unsupported content type", "method", r.Method, "url", r.URL.String(), "contentType", r.Header.Get("Content-Type"))
+			http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		_, span := startSpan(ctx, "decode admission review")
+		admissionReview, err := getAdmissionReviewFromRequest(r.Body)
+		if err == nil {
+			err = checkAdmissionReview(admissionReview)
+		}
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			slog.Error("Could not decode admission review", "method", r.Method, "url", r.URL.String(), "error", err)
+			statusCode := http.StatusBadRequest
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				statusCode = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), statusCode)
+			return
+		}
+
+		admissionRequest := admissionReview.Request
+		handlerName := registry.getHandlerName(admissionRequest, handlerName)
+		observeAdmissionHandler(w, handlerName)
+		logger := getAdmissionLogger(admissionRequest).With("admissionReviewVersion", admissionReview.APIVersion)
+		logger.Debug("Processing admission request")
+		setAdmissionSpanAttributes(getSpan(ctx), admissionRequest)
+
+		if isNamespaceExcluded(admissionRequest.Namespace, &serverConfig.Policy) {
+			logger.Debug("Namespace is excluded by the webhook policy")
+			writeAdmissionReview(w, logger, admissionReview, getAllowedAdmissionResponse(admissionRequest))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, getAdmissionDeadline(r))
+		defer cancel()
+
+		admission := &Admission{Request: admissionRequest, Logger: logger, ServerConfig: serverConfig, HandlerName: handlerName}
+		result := runAdmission(ctx, registry.admit, admission)
+		if result.err != nil {
+			logger.Error("Could not handle admission request", "reason", result.reason, "failurePolicy", serverConfig.Mutation.FailurePolicy, "error", result.err)
+			getSpan(ctx).RecordError(result.err)
+			writeAdmissionReview(w, logger, admissionReview, getFailureAdmissionResponse(admissionRequest, result.err, serverConfig.Mutation.FailurePolicy))
+			observeAdmissionFailure(w, handlerName, result.reason)
+			return
+		}
+
+		writeAdmissionReview(w, admission.Logger, admissionReview, result.response)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testMutationConfig = `{"topology.kubernetes.io/zone": ["a", "b"]}`
+
+// useServerConfig makes config the config in use for the rest of the test
+func useServerConfig(t *testing.T, config *ServerConfig) {
+	previous := getServerConfig()
+	currentServerConfig.Store(config)
+	t.Cleanup(func() { currentServerConfig.Store(previous) })
+}
+
+func newTestStatefulSet(annotations map[string]string) *appsv1.StatefulSet {
+	replicas := int32(3)
+	return &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "db",
+			UID:         "1234",
+			Annotations: annotations,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+			},
+		},
+	}
+}
+
+func newTestEnabledStatefulSet() *appsv1.StatefulSet {
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	return newTestStatefulSet(map[string]string{
+		annotationKeys.Enabled: "true",
+		annotationKeys.Config:  testMutationConfig,
+	})
+}
+
+// newTestPod returns the pod of an ordinal of a statefulset after the webhook
+// mutated the statefulset
+func newTestPod(t *testing.T, statefulSet *appsv1.StatefulSet, ordinal int) *corev1.Pod {
+	t.Helper()
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	mutationConfig, err := getMutationConfig(context.Background(), statefulSet, annotationKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutatedStatefulSet := statefulSet.DeepCopy()
+	if err := injectStatefulSetAnnotations(mutatedStatefulSet, mutationConfig, annotationKeys); err != nil {
+		t.Fatal(err)
+	}
+	return getStatefulSetPod(mutatedStatefulSet, ordinal)
+}
+
+func newTestAdmissionRequest(t *testing.T, object interface{}, gvk schema.GroupVersionKind, resource string) *admissionv1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admissionRequest := &admissionv1.AdmissionRequest{
+		UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Resource:  metav1.GroupVersionResource{Group: gvk.Group, Version: gvk.Version, Resource: resource},
+		Namespace: "db",
+		Operation: admissionv1.Create,
+	}
+	admissionRequest.Object.Raw = raw
+	return admissionRequest
+}
+
+func newTestPodAdmissionRequest(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	return newTestAdmissionRequest(t, pod, corev1.SchemeGroupVersion.WithKind("Pod"), "pods")
+}
+
+func newTestStatefulSetAdmissionRequest(t *testing.T, statefulSet *appsv1.StatefulSet) *admissionv1.AdmissionRequest {
+	return newTestAdmissionRequest(t, statefulSet, appsv1.SchemeGroupVersion.WithKind("StatefulSet"), "statefulsets")
+}
+
+// postAdmissionReview sends an admission review for the request to handler
+// and returns the response in the review it answers with
+func postAdmissionReview(t *testing.T, handler http.HandlerFunc, target string, admissionRequest *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	t.Helper()
+	recorder := postAdmissionReviewVersion(t, handler, target, "admission.k8s.io/v1", admissionRequest)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &admissionReview); err != nil || admissionReview.Response == nil {
+		t.Fatalf("Could not decode the admission review %s: %v", recorder.Body.String(), err)
+	}
+	return admissionReview.Response
+}
+
+// postAdmissionReviewVersion sends an admission review of the given
+// apiVersion, whose fields are the same in v1 and v1beta1
+func postAdmissionReviewVersion(t *testing.T, handler http.HandlerFunc, target string, apiVersion string, admissionRequest *admissionv1.AdmissionRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: "AdmissionReview"},
+		Request:  admissionRequest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", target, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+// blockingMutator is stuck until the request is given up on, like it would be
+// on a slow lookup, and then carries on
+type blockingMutator struct {
+	PodMutator
+	finished chan struct{}
+}
+
+func (m blockingMutator) Mutate(ctx context.Context, admission *Admission, object K8sObject) (*admissionv1.AdmissionResponse, error) {
+	defer close(m.finished)
+	<-ctx.Done()
+	return m.PodMutator.Mutate(ctx, admission, object)
+}
+
+func TestServeAdmissionTimeout(t *testing.T) {
+	serverConfig := defaultServerConfig()
+	serverConfig.Events.Enabled = true
+	useServerConfig(t, serverConfig)
+
+	eventRecorder = NewEventRecorder(nil, serverConfig.Events)
+	defer func() { eventRecorder = nil }()
+
+	finished := make(chan struct{})
+	registry := NewMutatorRegistry(blockingMutator{PodMutator: PodMutator{}, finished: finished})
+	before := metricValue(admissionFailuresTotal, "mutate-pods", "timeout")
+	pod := newTestPod(t, newTestEnabledStatefulSet(), 1)
+	admissionResponse := postAdmissionReview(t, serveAdmission("mutate-pods", registry), "/mutate-pods?timeout=50ms", newTestPodAdmissionRequest(t, pod))
+
+	if admissionResponse.Allowed || admissionResponse.Result == nil || admissionResponse.Result.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the request to be denied with the fail failure policy, got %+v", admissionResponse)
+	}
+	if admissionResponse.Result != nil && !strings.Contains(admissionResponse.Result.Message, "in time") {
+		t.Errorf("Expected a timeout message, got %q", admissionResponse.Result.Message)
+	}
+	if metricValue(admissionFailuresTotal, "mutate-pods", "timeout") != before+1 {
+		t.Errorf("Expected the timeout to be counted")
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Mutator did not finish")
+	}
+	if len(eventRecorder.queue) != 0 {
+		t.Errorf("Expected no event for a request that timed out, got %d", len(eventRecorder.queue))
+	}
+}
+
+func TestServeAdmissionReviewVersions(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	admissionRequest := newTestPodAdmissionRequest(t, newTestPod(t, newTestEnabledStatefulSet(), 1))
+	handler := serveAdmission("mutate", mutators)
+
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		t.Run(apiVersion, func(t *testing.T) {
+			recorder := postAdmissionReviewVersion(t, handler, "/mutate", apiVersion, admissionRequest)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			// the api server only accepts a response of the version it sent
+			var admissionReview admissionv1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &admissionReview); err != nil || admissionReview.Response == nil {
+				t.Fatalf("Could not decode the admission review %s: %v", recorder.Body.String(), err)
+			}
+			if admissionReview.APIVersion != apiVersion || admissionReview.Kind != "AdmissionReview" {
+				t.Errorf("Expected an AdmissionReview of version %s, got %s %s", apiVersion, admissionReview.APIVersion, admissionReview.Kind)
+			}
+			if admissionReview.Response.UID != admissionRequest.UID || !admissionReview.Response.Allowed || len(admissionReview.Response.Patch) == 0 {
+				t.Errorf("Expected the pod to be patched in a response with the uid of the request, got %+v", admissionReview.Response)
+			}
+		})
+	}
+
+	recorder := postAdmissionReviewVersion(t, handler, "/mutate", "admission.k8s.io/v2", admissionRequest)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown version to be rejected with status 400, got %d", recorder.Code)
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	admissionReviewBytes, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  newTestStatefulSetAdmissionRequest(t, newTestEnabledStatefulSet()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxBytes := int64(len(admissionReviewBytes))
+
+	tests := []struct {
+		name string
+		// whitespace the admission review is prefixed with
+		padding       int
+		contentLength bool
+		expectStatus  int
+		// whether serveAdmission gets to read the body
+		expectServed bool
+	}{
+		{name: "at the limit", contentLength: true, expectStatus: http.StatusOK, expectServed: true},
+		{name: "content length over the limit", padding: 1, contentLength: true, expectStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked body over the limit", padding: 1024, expectStatus: http.StatusRequestEntityTooLarge, expectServed: true},
+		{name: "chunked body at the limit", expectStatus: http.StatusOK, expectServed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// leading whitespace is still a valid admission review
+			body := append(bytes.Repeat([]byte(" "), test.padding), admissionReviewBytes...)
+			served := false
+			handler := limitRequestBody(maxBytes, func(w http.ResponseWriter, r *http.Request) {
+				served = true
+				serveAdmission("mutate", mutators)(w, r)
+			})
+
+			request := httptest.NewRequest("POST", "/mutate", bytes.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if !test.contentLength {
+				request.ContentLength = -1
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+
+			if recorder.Code != test.expectStatus {
+				t.Errorf("Expected status %d, got %d: %s", test.expectStatus, recorder.Code, recorder.Body.String())
+			}
+			if served != test.expectServed {
+				t.Errorf("Expected the admission review to be served %v, got %v", test.expectServed, served)
+			}
+		})
+	}
+}
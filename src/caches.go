@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const configMapReferencePrefix = "configmap:"
+
+type CacheOptions struct {
+	EnableNamespaceDefaults   bool   `json:"enableNamespaceDefaults"`
+	EnableConfigMapReferences bool   `json:"enableConfigMapReferences"`
+	ConfigMapLabelSelector    string `json:"configMapLabelSelector"`
+	// namespaces whose configmaps are cached and can be referenced from any
+	// namespace, if empty configmaps can only be referenced from their own
+	// namespace
+	ConfigMapNamespaces []string `json:"configMapNamespaces"`
+	SyncTimeoutSeconds  int      `json:"syncTimeoutSeconds"`
+}
+
+// the informers are nil unless the feature that needs them is enabled. The
+// configmap informers are keyed by namespace, "" is the informer of all
+// namespaces.
+var (
+	namespaceInformer  *Informer[corev1.Namespace, *corev1.Namespace]
+	configMapInformers map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]
+)
+
+func (o *CacheOptions) isEnabled() bool {
+	return o.EnableNamespaceDefaults || o.EnableConfigMapReferences
+}
+
+func startCaches(ctx context.Context, client *KubeClient, cacheOptions *CacheOptions) error {
+	if !cacheOptions.isEnabled() {
+		return nil
+	}
+	readinessChecks.Add("caches", checkCaches)
+
+	syncCtx, cancel := context.WithTimeout(ctx, time.Duration(cacheOptions.SyncTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	if cacheOptions.EnableNamespaceDefaults {
+		namespaceInformer = NewInformer[corev1.Namespace](client, "/api/v1/namespaces", "")
+		go namespaceInformer.Run(ctx)
+	}
+
+	if cacheOptions.EnableConfigMapReferences {
+		configMapInformers = make(map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap])
+		configMapNamespaces := cacheOptions.ConfigMapNamespaces
+		if len(configMapNamespaces) == 0 {
+			configMapNamespaces = []string{""}
+		}
+
+		for _, configMapNamespace := range configMapNamespaces {
+			path := "/api/v1/configmaps"
+			if configMapNamespace != "" {
+				path = "/api/v1/namespaces/" + configMapNamespace + "/configmaps"
+			}
+			configMapInformer := NewInformer[corev1.ConfigMap](client, path, cacheOptions.ConfigMapLabelSelector)
+			configMapInformers[configMapNamespace] = configMapInformer
+			go configMapInformer.Run(ctx)
+		}
+	}
+
+	if namespaceInformer != nil {
+		if err := namespaceInformer.WaitForSync(syncCtx); err != nil {
+			return err
+		}
+		slog.Info("Namespace cache synced")
+	}
+
+	for configMapNamespace, configMapInformer := range configMapInformers {
+		if err := configMapInformer.WaitForSync(syncCtx); err != nil {
+			return err
+		}
+		slog.Info("ConfigMap cache synced", "namespace", configMapNamespace)
+	}
+
+	return nil
+}
+
+// describeMutationConfigValue names where a config value comes from, either
+// the object it is set on or the configmap it references
+func describeMutationConfigValue(value string, namespace string, object string) string {
+	if !strings.HasPrefix(value, configMapReferencePrefix) {
+		return object
+	}
+
+	location, key, _ := strings.Cut(strings.TrimPrefix(value, configMapReferencePrefix), "#")
+	if !strings.Contains(location, "/") {
+		location = namespace + "/" + location
+	}
+	return configMapReferencePrefix + location + "#" + key
+}
+
+// resolveMutationConfigValue returns the config json for a config annotation
+// value, which is either the json itself or a reference of the form
+// configmap:namespace/name#key. The namespace defaults to the given one.
+func resolveMutationConfigValue(ctx context.Context, value string, namespace string) (string, error) {
+	if !strings.HasPrefix(value, configMapReferencePrefix) {
+		return value, nil
+	}
+
+	_, span := startSpan(ctx, "lookup configmap")
+	defer span.End()
+	span.SetAttributes("configmap.reference", value)
+
+	reference := strings.TrimPrefix(value, configMapReferencePrefix)
+	location, key, ok := strings.Cut(reference, "#")
+	if !ok || location == "" || key == "" {
+		err := fmt.Errorf("ConfigMap reference %q must be of the form %snamespace/name#key", value, configMapReferencePrefix)
+		span.RecordError(err)
+		return "", err
+	}
+
+	configMapNamespace, configMapName, ok := strings.Cut(location, "/")
+	if !ok {
+		configMapNamespace, configMapName = namespace, location
+	}
+
+	if configMapInformers == nil {
+		err := fmt.Errorf("ConfigMap reference %q can not be resolved because configmap references are not enabled on the webhook", value)
+		span.RecordError(err)
+		return "", err
+	}
+
+	// checked before the lookup, so the configmaps of other namespaces can
+	// neither be read nor probed for
+	configMapInformer, ok := getConfigMapInformer(configMapNamespace, namespace)
+	if !ok {
+		err := fmt.Errorf("ConfigMap reference %q can not be resolved because configmaps in namespace %s can not be referenced from namespace %s", value, configMapNamespace, namespace)
+		span.RecordError(err)
+		return "", err
+	}
+
+	configMap, ok := configMapInformer.Get(configMapNamespace, configMapName)
+	if !ok {
+		err := fmt.Errorf("ConfigMap %s/%s referenced by %q does not exist", configMapNamespace, configMapName, value)
+		span.RecordError(err)
+		return "", err
+	}
+
+	data, ok := configMap.Data[key]
+	if !ok {
+		err := fmt.Errorf("ConfigMap %s/%s referenced by %q does not have key %s", configMapNamespace, configMapName, value, key)
+		span.RecordError(err)
+		return "", err
+	}
+
+	return data, nil
+}
+
+// getConfigMapInformer returns the informer of the configmaps an object in
+// the given namespace may reference in configMapNamespace. Without namespaces
+// configured these are only the configmaps of its own namespace.
+func getConfigMapInformer(configMapNamespace string, namespace string) (*Informer[corev1.ConfigMap, *corev1.ConfigMap], bool) {
+	if configMapInformer, ok := configMapInformers[""]; ok {
+		return configMapInformer, configMapNamespace == namespace
+	}
+
+	configMapInformer, ok := configMapInformers[configMapNamespace]
+	return configMapInformer, ok
+}
+
+func getNamespaceMutationConfigAnnotation(namespaceName string, annotationKeys AnnotationKeys) (string, bool) {
+	if namespaceInformer == nil {
+		return "", false
+	}
+
+	namespace, ok := namespaceInformer.Get("", namespaceName)
+	if !ok {
+		return "", false
+	}
+
+	mutationConfigAnnotation, ok := namespace.Annotations[annotationKeys.Config]
+	return mutationConfigAnnotation, ok
+}
+
+// getNamespaceMutationConfig returns the default mutation config set on the
+// namespace, or nil if namespace defaults are disabled or the namespace has none
+func getNamespaceMutationConfig(ctx context.Context, namespaceName string, annotationKeys AnnotationKeys) (map[string][]string, error) {
+	if namespaceInformer == nil {
+		return nil, nil
+	}
+
+	ctx, span := startSpan(ctx, "lookup namespace")
+	defer span.End()
+
+	mutationConfigAnnotation, ok := getNamespaceMutationConfigAnnotation(namespaceName, annotationKeys)
+	span.SetAttributes("k8s.namespace.name", namespaceName, "namespace.has_config", ok)
+	if !ok {
+		return nil, nil
+	}
+
+	mutationConfigValue, err := resolveMutationConfigValue(ctx, mutationConfigAnnotation, namespaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve \"%s\" value on namespace %s: %v", annotationKeys.Config, namespaceName, err)
+	}
+
+	mutationConfig, err := parseMutationConfig(mutationConfigValue)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing \"%s\" value on namespace %s: %v", annotationKeys.Config, namespaceName, err)
+	}
+
+	return mutationConfig, nil
+}
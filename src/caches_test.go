@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newTestConfigMap(namespace string, name string, data map[string]string) *corev1.ConfigMap {
+	configMap := &corev1.ConfigMap{Data: data}
+	configMap.Namespace = namespace
+	configMap.Name = name
+	return configMap
+}
+
+// newTestConfigMapInformer returns a synced informer holding the configmaps
+func newTestConfigMapInformer(configMaps ...*corev1.ConfigMap) *Informer[corev1.ConfigMap, *corev1.ConfigMap] {
+	informer := NewInformer[corev1.ConfigMap](nil, "", "")
+	for _, configMap := range configMaps {
+		informer.items[informerKey(configMap.Namespace, configMap.Name)] = configMap
+	}
+	close(informer.synced)
+	return informer
+}
+
+func useConfigMapInformers(t *testing.T, informers map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]) {
+	t.Helper()
+	previous := configMapInformers
+	configMapInformers = informers
+	t.Cleanup(func() { configMapInformers = previous })
+}
+
+func TestResolveMutationConfigValue(t *testing.T) {
+	databases := newTestConfigMap("databases", "placement", map[string]string{"db": testMutationConfig})
+	shared := newTestConfigMap("shared", "placement", map[string]string{"db": `{"disktype": ["ssd"]}`})
+
+	tests := []struct {
+		name      string
+		informers map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]
+		value     string
+		namespace string
+		expected  string
+		message   string
+	}{
+		{
+			name:      "inline config",
+			value:     testMutationConfig,
+			namespace: "databases",
+			expected:  testMutationConfig,
+		},
+		{
+			name:      "references not enabled",
+			value:     "configmap:placement#db",
+			namespace: "databases",
+			message:   "configmap references are not enabled",
+		},
+		{
+			name:      "malformed reference",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases)},
+			value:     "configmap:placement",
+			namespace: "databases",
+			message:   "must be of the form",
+		},
+		{
+			name:      "own namespace",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases, shared)},
+			value:     "configmap:placement#db",
+			namespace: "databases",
+			expected:  testMutationConfig,
+		},
+		{
+			name:      "own namespace spelled out",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases, shared)},
+			value:     "configmap:databases/placement#db",
+			namespace: "databases",
+			expected:  testMutationConfig,
+		},
+		{
+			// existing or not, the configmap is not looked up
+			name:      "other namespace",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases, shared)},
+			value:     "configmap:shared/placement#db",
+			namespace: "databases",
+			message:   "configmaps in namespace shared can not be referenced from namespace databases",
+		},
+		{
+			name:      "missing configmap",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases)},
+			value:     "configmap:other#db",
+			namespace: "databases",
+			message:   "ConfigMap databases/other referenced by \"configmap:other#db\" does not exist",
+		},
+		{
+			name:      "missing key",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"": newTestConfigMapInformer(databases)},
+			value:     "configmap:placement#web",
+			namespace: "databases",
+			message:   "does not have key web",
+		},
+		{
+			name:      "listed namespace",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"shared": newTestConfigMapInformer(shared)},
+			value:     "configmap:shared/placement#db",
+			namespace: "databases",
+			expected:  `{"disktype": ["ssd"]}`,
+		},
+		{
+			name:      "own namespace that is not listed",
+			informers: map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{"shared": newTestConfigMapInformer(shared)},
+			value:     "configmap:placement#db",
+			namespace: "databases",
+			message:   "configmaps in namespace databases can not be referenced from namespace databases",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useConfigMapInformers(t, test.informers)
+
+			value, err := resolveMutationConfigValue(context.Background(), test.value, test.namespace)
+			if test.message != "" {
+				if err == nil || !strings.Contains(err.Error(), test.message) {
+					t.Errorf("Expected an error containing %q, got %v", test.message, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, value)
+			}
+		})
+	}
+}
+
+// useNamespaceInformer makes a synced informer holding the namespaces the
+// namespace cache for the rest of the test
+func useNamespaceInformer(t *testing.T, namespaces ...*corev1.Namespace) {
+	t.Helper()
+	informer := NewInformer[corev1.Namespace](nil, "", "")
+	for _, namespace := range namespaces {
+		informer.items[informerKey("", namespace.Name)] = namespace
+	}
+	close(informer.synced)
+
+	previous := namespaceInformer
+	namespaceInformer = informer
+	t.Cleanup(func() { namespaceInformer = previous })
+}
+
+func TestMergeMutationConfigs(t *testing.T) {
+	defaults := map[string][]string{testZoneKey: {"a", "b"}, "disktype": {"ssd"}}
+	overrides := map[string][]string{testZoneKey: {"c"}, "node.example.com/rack": {"r1"}}
+
+	merged := mergeMutationConfigs(defaults, overrides)
+	assertJSONEqual(t, merged, map[string][]string{testZoneKey: {"c"}, "disktype": {"ssd"}, "node.example.com/rack": {"r1"}})
+	// neither config is changed
+	assertJSONEqual(t, defaults, map[string][]string{testZoneKey: {"a", "b"}, "disktype": {"ssd"}})
+	assertJSONEqual(t, overrides, map[string][]string{testZoneKey: {"c"}, "node.example.com/rack": {"r1"}})
+
+	assertJSONEqual(t, mergeMutationConfigs(nil, overrides), overrides)
+	assertJSONEqual(t, mergeMutationConfigs(defaults, nil), defaults)
+}
+
+func TestGetMutationConfigMergesNamespaceDefaults(t *testing.T) {
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	newNamespace := func(name string, annotations map[string]string) *corev1.Namespace {
+		namespace := &corev1.Namespace{}
+		namespace.Name = name
+		namespace.Annotations = annotations
+		return namespace
+	}
+	namespaceDefault := `{"topology.kubernetes.io/zone": ["a", "b"], "disktype": ["ssd"]}`
+
+	tests := []struct {
+		name string
+		// the namespace cache is disabled if nil
+		namespace *corev1.Namespace
+		// the config annotation of the statefulset, unset if empty
+		config   string
+		expected map[string][]string
+		source   string
+		message  string
+	}{
+		{
+			name:      "namespace default only",
+			namespace: newNamespace("db", map[string]string{annotationKeys.Config: namespaceDefault}),
+			expected:  map[string][]string{testZoneKey: {"a", "b"}, "disktype": {"ssd"}},
+			source:    "namespace",
+		},
+		{
+			name:      "object keys replace namespace keys",
+			namespace: newNamespace("db", map[string]string{annotationKeys.Config: namespaceDefault}),
+			config:    `{"topology.kubernetes.io/zone": ["c"], "node.example.com/rack": ["r1"]}`,
+			expected:  map[string][]string{testZoneKey: {"c"}, "disktype": {"ssd"}, "node.example.com/rack": {"r1"}},
+			source:    "namespace + annotation",
+		},
+		{
+			name:      "empty override keeps the namespace default",
+			namespace: newNamespace("db", map[string]string{annotationKeys.Config: namespaceDefault}),
+			config:    `{}`,
+			expected:  map[string][]string{testZoneKey: {"a", "b"}, "disktype": {"ssd"}},
+			source:    "namespace + annotation",
+		},
+		{
+			name:      "namespace without default",
+			namespace: newNamespace("db", map[string]string{"other": "annotation"}),
+			config:    testMutationConfig,
+			expected:  map[string][]string{testZoneKey: {"a", "b"}},
+			source:    "annotation",
+		},
+		{
+			name:      "namespace missing from the cache",
+			namespace: newNamespace("other", map[string]string{annotationKeys.Config: namespaceDefault}),
+			config:    testMutationConfig,
+			expected:  map[string][]string{testZoneKey: {"a", "b"}},
+			source:    "annotation",
+		},
+		{
+			name:      "namespace missing and no object config",
+			namespace: newNamespace("other", map[string]string{annotationKeys.Config: namespaceDefault}),
+			message:   "does not have \"" + annotationKeys.Config + "\" annotation and the namespace has no default config",
+		},
+		{
+			name:     "namespace defaults disabled",
+			config:   `{"disktype": ["ssd"]}`,
+			expected: map[string][]string{"disktype": {"ssd"}},
+			source:   "annotation",
+		},
+		{
+			name:      "invalid namespace default",
+			namespace: newNamespace("db", map[string]string{annotationKeys.Config: `{"disktype": []}`}),
+			config:    testMutationConfig,
+			message:   "Error parsing \"" + annotationKeys.Config + "\" value on namespace db: node label disktype has no values",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.namespace != nil {
+				useNamespaceInformer(t, test.namespace)
+			} else {
+				previous := namespaceInformer
+				namespaceInformer = nil
+				t.Cleanup(func() { namespaceInformer = previous })
+			}
+
+			annotations := map[string]string{annotationKeys.Enabled: "true"}
+			if test.config != "" {
+				annotations[annotationKeys.Config] = test.config
+			}
+			statefulSet := newTestStatefulSet(annotations)
+
+			mutationConfig, err := getMutationConfig(context.Background(), statefulSet, annotationKeys)
+			if test.message != "" {
+				if err == nil || !strings.Contains(err.Error(), test.message) {
+					t.Errorf("Expected an error containing %q, got %v", test.message, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, mutationConfig, test.expected)
+			if source := getMutationConfigSource(statefulSet, annotationKeys); source != test.source {
+				t.Errorf("Expected config source %q, got %q", test.source, source)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "go.yaml.in/yaml/v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// chartName is the name of the helm chart, the defaults of the chart's name
+// helpers are derived from it
+const chartName = "statefulset-affinity-injector"
+
+type CertgenOptions struct {
+	Namespace        string
+	Release          string
+	Service          string
+	NameOverride     string
+	FullnameOverride string
+	ClusterDomain    string
+	ExtraSANs        []string
+
+	KeyType        string
+	RSABits        int
+	ValidityDays   int
+	CAValidityDays int
+
+	OutputDir      string
+	ValuesFile     string
+	SecretManifest string
+	Overwrite      bool
+}
+
+// truncateName mirrors `trunc 63 | trimSuffix "-"` in the chart helpers
+func truncateName(name string) string {
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimSuffix(name, "-")
+}
+
+// getChartName mirrors the statefulset-affinity-injector.name helper
+func getChartName(nameOverride string) string {
+	if nameOverride == "" {
+		return truncateName(chartName)
+	}
+	return truncateName(nameOverride)
+}
+
+// getChartFullname mirrors the statefulset-affinity-injector.fullname
+// helper, which is also the name of the webhook service
+func getChartFullname(release string, nameOverride string, fullnameOverride string) string {
+	if fullnameOverride != "" {
+		return truncateName(fullnameOverride)
+	}
+
+	name := chartName
+	if nameOverride != "" {
+		name = nameOverride
+	}
+
+	if strings.Contains(release, name) {
+		return truncateName(release)
+	}
+	return truncateName(release + "-" + name)
+}
+
+func (o *CertgenOptions) validate() error {
+	if o.Namespace == "" {
+		return fmt.Errorf("-namespace is required")
+	}
+
+	if o.Service == "" && o.Release == "" && o.FullnameOverride == "" {
+		return fmt.Errorf("one of -service, -release or -fullname-override is required")
+	}
+
+	if o.KeyType != keyTypeECDSA && o.KeyType != keyTypeRSA {
+		return fmt.Errorf("-key-type must be %s or %s, got %q", keyTypeECDSA, keyTypeRSA, o.KeyType)
+	}
+
+	if o.KeyType == keyTypeRSA && o.RSABits < 2048 {
+		return fmt.Errorf("-rsa-bits must be at least 2048")
+	}
+
+	if o.ValidityDays <= 0 || o.CAValidityDays < o.ValidityDays {
+		return fmt.Errorf("-validity-days must be positive and -ca-validity-days can not be less than -validity-days")
+	}
+
+	return nil
+}
+
+func (o *CertgenOptions) getServiceName() string {
+	if o.Service != "" {
+		return o.Service
+	}
+	return getChartFullname(o.Release, o.NameOverride, o.FullnameOverride)
+}
+
+// getSubjectAlternativeNames returns the service dns names followed by the
+// extra sans, which are ip addresses if they parse as one
+func (o *CertgenOptions) getSubjectAlternativeNames() ([]string, []net.IP) {
+	dnsNames := getServiceDNSNames(o.getServiceName(), o.Namespace, o.ClusterDomain)
+	var ipAddresses []net.IP
+	for _, san := range o.ExtraSANs {
+		if ip := net.ParseIP(san); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, san)
+		}
+	}
+	return dnsNames, ipAddresses
+}
+
+func newCertgenFlagSet(options *CertgenOptions) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("certgen", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s certgen -namespace NAMESPACE (-release RELEASE | -service SERVICE) [flags]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flagSet.Output(), "Generates a CA and a serving certificate for the webhook service.\n\n")
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.StringVar(&options.Namespace, "namespace", "", "namespace the chart is installed in")
+	flagSet.StringVar(&options.Release, "release", "", "helm release name, the service name is derived from it like the chart does")
+	flagSet.StringVar(&options.Service, "service", "", "name of the webhook service, takes precedence over -release")
+	flagSet.StringVar(&options.NameOverride, "name-override", "", "nameOverride of the chart")
+	flagSet.StringVar(&options.FullnameOverride, "fullname-override", "", "fullnameOverride of the chart")
+	flagSet.StringVar(&options.ClusterDomain, "cluster-domain", "cluster.local", "cluster domain used in the dns names of the certificate")
+	flagSet.Var(stringListFlag{&options.ExtraSANs}, "extra-sans", "comma separated extra dns names or ip addresses of the certificate")
+
+	flagSet.StringVar(&options.KeyType, "key-type", keyTypeECDSA, "type of the generated keys, ecdsa (p-256) or rsa")
+	flagSet.IntVar(&options.RSABits, "rsa-bits", 2048, "size of rsa keys")
+	flagSet.IntVar(&options.ValidityDays, "validity-days", 365, "number of days the serving certificate is valid")
+	flagSet.IntVar(&options.CAValidityDays, "ca-validity-days", 3650, "number of days the CA is valid")
+
+	flagSet.StringVar(&options.OutputDir, "output-dir", ".", "directory ca.crt, ca.key, tls.crt and tls.key are written to")
+	flagSet.StringVar(&options.ValuesFile, "values-file", "", "also write a helm values file with the certificate to this path")
+	flagSet.StringVar(&options.SecretManifest, "secret-manifest", "", "also write a Secret manifest with the certificate to this path")
+	flagSet.BoolVar(&options.Overwrite, "overwrite", false, "overwrite existing files")
+	return flagSet
+}
+
+type generatedCertificates struct {
+	caPEM       []byte
+	caKeyPEM    []byte
+	certPEM     []byte
+	keyPEM      []byte
+	dnsNames    []string
+	ipAddresses []net.IP
+	expiry      time.Time
+}
+
+func generateCertificates(options *CertgenOptions) (*generatedCertificates, error) {
+	caKey, err := generatePrivateKey(options.KeyType, options.RSABits)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generatePrivateKey(options.KeyType, options.RSABits)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := options.getServiceName()
+	ca, err := generateCertificateAuthority(serviceName+"-ca", days(options.CAValidityDays), caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames, ipAddresses := options.getSubjectAlternativeNames()
+	certificate, err := generateServingCertificate(ca, caKey, dnsNames, ipAddresses, days(options.ValidityDays), key)
+	if err != nil {
+		return nil, err
+	}
+
+	caKeyPEM, err := encodePrivateKeyPEM(caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &generatedCertificates{
+		caPEM:       encodeCertificatePEM(ca),
+		caKeyPEM:    caKeyPEM,
+		certPEM:     encodeCertificatePEM(certificate),
+		keyPEM:      keyPEM,
+		dnsNames:    dnsNames,
+		ipAddresses: ipAddresses,
+		expiry:      certificate.NotAfter,
+	}, nil
+}
+
+func writeCertgenFile(path string, content []byte, mode os.FileMode, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+
+	file, err := os.OpenFile(path, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use -overwrite to replace it", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not create %s: %v", path, err)
+	}
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("Could not write %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// getCertgenValues returns a values file for the chart, the chart expects PEM
+// encoded values and encodes them itself
+func getCertgenValues(certificates *generatedCertificates) ([]byte, error) {
+	return yaml.Marshal(yaml.MapSlice{
+		{Key: "tls", Value: yaml.MapSlice{
+			{Key: "cert", Value: string(certificates.certPEM)},
+			{Key: "key", Value: string(certificates.keyPEM)},
+			{Key: "caBundle", Value: string(certificates.caPEM)},
+		}},
+	})
+}
+
+// getCertgenSecretName returns the name of the Secret certgen writes. It is
+// not the name of the Secret the chart creates from tls.cert and tls.key, so
+// helm does not take it over, and is passed to the chart as tls.existingSecret.
+func getCertgenSecretName(options *CertgenOptions) string {
+	return truncateName(getChartName(options.NameOverride) + "-certgen-tls")
+}
+
+// getCertgenSecret returns a kubernetes.io/tls Secret manifest for the
+// certificates
+func getCertgenSecret(options *CertgenOptions, certificates *generatedCertificates) ([]byte, error) {
+	secret, err := yaml.Marshal(yaml.MapSlice{
+		{Key: "apiVersion", Value: "v1"},
+		{Key: "kind", Value: "Secret"},
+		{Key: "metadata", Value: yaml.MapSlice{
+			{Key: "name", Value: getCertgenSecretName(options)},
+			{Key: "namespace", Value: options.Namespace},
+		}},
+		{Key: "type", Value: string(corev1.SecretTypeTLS)},
+		{Key: "data", Value: yaml.MapSlice{
+			{Key: certificateSecretCABundleKey, Value: base64.StdEncoding.EncodeToString(certificates.caPEM)},
+			{Key: corev1.TLSCertKey, Value: base64.StdEncoding.EncodeToString(certificates.certPEM)},
+			{Key: corev1.TLSPrivateKeyKey, Value: base64.StdEncoding.EncodeToString(certificates.keyPEM)},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal secret manifest: %v", err)
+	}
+	return secret, nil
+}
+
+func runCertgen(args []string) error {
+	var options CertgenOptions
+	newCertgenFlagSet(&options).Parse(args)
+
+	if err := options.validate(); err != nil {
+		return err
+	}
+
+	certificates, err := generateCertificates(&options)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{"ca.crt", certificates.caPEM, 0644},
+		{"ca.key", certificates.caKeyPEM, 0600},
+		{corev1.TLSCertKey, certificates.certPEM, 0644},
+		{corev1.TLSPrivateKeyKey, certificates.keyPEM, 0600},
+	}
+
+	if err := os.MkdirAll(options.OutputDir, 0755); err != nil {
+		return fmt.Errorf("Could not create output directory %s: %v", options.OutputDir, err)
+	}
+
+	for _, file := range files {
+		path := filepath.Join(options.OutputDir, file.name)
+		if err := writeCertgenFile(path, file.content, file.mode, options.Overwrite); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+
+	if options.ValuesFile != "" {
+		values, err := getCertgenValues(certificates)
+		if err != nil {
+			return fmt.Errorf("Could not marshal values file: %v", err)
+		}
+
+		// the values file contains the private key
+		if err := writeCertgenFile(options.ValuesFile, values, 0600, options.Overwrite); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", options.ValuesFile)
+	}
+
+	if options.SecretManifest != "" {
+		secret, err := getCertgenSecret(&options, certificates)
+		if err != nil {
+			return err
+		}
+
+		if err := writeCertgenFile(options.SecretManifest, secret, 0600, options.Overwrite); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s, install the chart with --set tls.existingSecret=%s --set-file tls.caBundle=%s\n", options.SecretManifest, getCertgenSecretName(&options), filepath.Join(options.OutputDir, "ca.crt"))
+	}
+
+	sans := append([]string(nil), certificates.dnsNames...)
+	for _, ip := range certificates.ipAddresses {
+		sans = append(sans, ip.String())
+	}
+	fmt.Printf("Certificate is valid for %s until %s\n", strings.Join(sans, ", "), certificates.expiry.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "go.yaml.in/yaml/v2"
+)
+
+const testChartDir = "../charts/statefulset-affinity-injector"
+
+// the helpers are copied from the chart, so a change to the chart has to be
+// made to certgen too
+func TestChartNameHelpersMatchChart(t *testing.T) {
+	chartBytes, err := os.ReadFile(filepath.Join(testChartDir, "Chart.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chart struct {
+		Name string `yaml:"name"`
+	}
+	if err := yaml.Unmarshal(chartBytes, &chart); err != nil {
+		t.Fatal(err)
+	}
+	if chart.Name != chartName {
+		t.Errorf("Expected chartName to be the chart name %q, got %q", chart.Name, chartName)
+	}
+
+	helpersBytes, err := os.ReadFile(filepath.Join(testChartDir, "templates", "_helpers.tpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`{{- default .Chart.Name .Values.nameOverride | trunc 63 | trimSuffix "-" }}`,
+		`{{- .Values.fullnameOverride | trunc 63 | trimSuffix "-" }}`,
+		`{{- $name := default .Chart.Name .Values.nameOverride }}`,
+		`{{- if contains $name .Release.Name }}`,
+		`{{- .Release.Name | trunc 63 | trimSuffix "-" }}`,
+		`{{- printf "%s-%s" .Release.Name $name | trunc 63 | trimSuffix "-" }}`,
+	} {
+		if !strings.Contains(string(helpersBytes), line) {
+			t.Errorf("The chart helpers no longer contain %q, update getChartName and getChartFullname", line)
+		}
+	}
+}
+
+func TestGetChartFullname(t *testing.T) {
+	longName := strings.Repeat("a", 62) + "-b"
+
+	tests := []struct {
+		name             string
+		release          string
+		nameOverride     string
+		fullnameOverride string
+		expected         string
+	}{
+		{
+			name:     "release and chart name",
+			release:  "prod",
+			expected: "prod-statefulset-affinity-injector",
+		},
+		{
+			name:     "release is the chart name",
+			release:  "statefulset-affinity-injector",
+			expected: "statefulset-affinity-injector",
+		},
+		{
+			name:     "release contains the chart name",
+			release:  "prod-statefulset-affinity-injector-v2",
+			expected: "prod-statefulset-affinity-injector-v2",
+		},
+		{
+			name:         "name override",
+			release:      "prod",
+			nameOverride: "injector",
+			expected:     "prod-injector",
+		},
+		{
+			name:         "release contains the name override",
+			release:      "prod-injector",
+			nameOverride: "injector",
+			expected:     "prod-injector",
+		},
+		{
+			name:         "release contains the chart name but not the name override",
+			release:      "statefulset-affinity-injector",
+			nameOverride: "webhook",
+			expected:     "statefulset-affinity-injector-webhook",
+		},
+		{
+			name:             "fullname override",
+			release:          "prod",
+			nameOverride:     "injector",
+			fullnameOverride: "placement-webhook",
+			expected:         "placement-webhook",
+		},
+		{
+			name:             "long fullname override",
+			fullnameOverride: longName,
+			expected:         strings.Repeat("a", 62),
+		},
+		{
+			name:     "long release",
+			release:  strings.Repeat("r", 40),
+			expected: strings.Repeat("r", 40) + "-statefulset-affinity-i",
+		},
+		{
+			name:     "truncated at a dash",
+			release:  strings.Repeat("r", 41),
+			expected: strings.Repeat("r", 41) + "-statefulset-affinity",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fullname := getChartFullname(test.release, test.nameOverride, test.fullnameOverride)
+			if fullname != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, fullname)
+			}
+
+			// the service name is the fullname unless it is given
+			options := &CertgenOptions{Release: test.release, NameOverride: test.nameOverride, FullnameOverride: test.fullnameOverride}
+			if serviceName := options.getServiceName(); serviceName != test.expected {
+				t.Errorf("Expected service name %q, got %q", test.expected, serviceName)
+			}
+		})
+	}
+
+	options := &CertgenOptions{Release: "prod", Service: "webhook"}
+	if serviceName := options.getServiceName(); serviceName != "webhook" {
+		t.Errorf("Expected the given service name, got %q", serviceName)
+	}
+}
+
+func TestGetChartName(t *testing.T) {
+	for nameOverride, expected := range map[string]string{
+		"":                            chartName,
+		"injector":                    "injector",
+		strings.Repeat("n", 62) + "-": strings.Repeat("n", 62),
+	} {
+		if name := getChartName(nameOverride); name != expected {
+			t.Errorf("Expected the name for override %q to be %q, got %q", nameOverride, expected, name)
+		}
+	}
+
+	if secretName := getCertgenSecretName(&CertgenOptions{NameOverride: "injector"}); secretName != "injector-certgen-tls" {
+		t.Errorf("Expected the certgen secret to be named after the chart name, got %q", secretName)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"slices"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	keyTypeECDSA = "ecdsa"
+	keyTypeRSA   = "rsa"
+
+	certificateSecretCAKey = "ca.key"
+	// ca.crt holds the current ca first, followed by older cas that may
+	// still have signed a serving certificate in use
+	certificateSecretCABundleKey = "ca.crt"
+
+	certificateReconcileInterval = time.Minute
+	certificateWaitTimeout       = 2 * time.Minute
+	// certificates are valid from a bit in the past to allow for clock skew
+	certificateBackdate = time.Hour
+)
+
+type CertificateOptions struct {
+	// generate and rotate the ca and serving certificate instead of reading
+	// them from files
+	SelfManaged bool `json:"selfManaged"`
+	// namespace of the secret and the lease, defaults to the namespace of
+	// the webhook pod
+	Namespace                string `json:"namespace"`
+	SecretName               string `json:"secretName"`
+	LeaseName                string `json:"leaseName"`
+	WebhookConfigurationName string `json:"webhookConfigurationName"`
+	// the serving certificate is valid for the names of this service
+	ServiceName     string `json:"serviceName"`
+	ClusterDomain   string `json:"clusterDomain"`
+	CAValidityDays  int    `json:"caValidityDays"`
+	ValidityDays    int    `json:"validityDays"`
+	RenewBeforeDays int    `json:"renewBeforeDays"`
+}
+
+func (o *CertificateOptions) validate() error {
+	if !o.SelfManaged {
+		return nil
+	}
+
+	if o.SecretName == "" || o.LeaseName == "" || o.WebhookConfigurationName == "" || o.ServiceName == "" {
+		return fmt.Errorf("certificates.secretName, certificates.leaseName, certificates.webhookConfigurationName and certificates.serviceName are required for self managed certificates")
+	}
+
+	if o.ValidityDays <= 0 || o.RenewBeforeDays <= 0 || o.RenewBeforeDays >= o.ValidityDays {
+		return fmt.Errorf("certificates.validityDays and certificates.renewBeforeDays must be positive, and renewBeforeDays must be less than validityDays")
+	}
+
+	// a ca is rotated while it can still sign a full serving certificate
+	if o.CAValidityDays <= o.ValidityDays+o.RenewBeforeDays {
+		return fmt.Errorf("certificates.caValidityDays must be more than validityDays plus renewBeforeDays")
+	}
+
+	return nil
+}
+
+func days(count int) time.Duration {
+	return time.Duration(count) * 24 * time.Hour
+}
+
+// getServiceDNSNames returns the names the api server may use to call the
+// webhook service
+func getServiceDNSNames(serviceName string, namespace string, clusterDomain string) []string {
+	return []string{
+		serviceName,
+		serviceName + "." + namespace,
+		serviceName + "." + namespace + ".svc",
+		serviceName + "." + namespace + ".svc." + clusterDomain,
+	}
+}
+
+func encodeCertificatePEM(certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+}
+
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+func parseCertificatesPEM(certificatesPEM []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certificatesPEM = pem.Decode(certificatesPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse certificate: %v", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("Could not find a PEM encoded certificate")
+	}
+	return certificates, nil
+}
+
+func parsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("Could not find a PEM encoded PKCS #8 private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Private key of type %T can not sign certificates", key)
+	}
+	return signer, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate serial number: %v", err)
+	}
+	return serialNumber, nil
+}
+
+// generatePrivateKey generates an ecdsa p-256 key, or an rsa key of rsaBits
+func generatePrivateKey(keyType string, rsaBits int) (crypto.Signer, error) {
+	switch keyType {
+	case keyTypeECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Could not generate ecdsa private key: %v", err)
+		}
+		return key, nil
+	case keyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return nil, fmt.Errorf("Could not generate rsa private key: %v", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Unknown key type %q, must be %s or %s", keyType, keyTypeECDSA, keyTypeRSA)
+	}
+}
+
+// signCertificate creates a certificate from template for key. The
+// certificate is self signed if parent is nil.
+func signCertificate(template *x509.Certificate, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serialNumber
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create certificate %s: %v", template.Subject.CommonName, err)
+	}
+
+	certificate, err := x509.ParseCertificate(certificateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse certificate %s: %v", template.Subject.CommonName, err)
+	}
+
+	return certificate, nil
+}
+
+func generateCertificateAuthority(commonName string, validity time.Duration, key crypto.Signer) (*x509.Certificate, error) {
+	now := time.Now()
+	return signCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-certificateBackdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, key, nil, nil)
+}
+
+func generateServingCertificate(ca *x509.Certificate, caKey crypto.Signer, dnsNames []string, ipAddresses []net.IP, validity time.Duration, key crypto.Signer) (*x509.Certificate, error) {
+	keyUsage := x509.KeyUsageDigitalSignature
+	// rsa keys are also used for key exchange by older tls versions
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	now := time.Now()
+	return signCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
+		NotBefore:   now.Add(-certificateBackdate),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key, ca, caKey)
+}
+
+// CertificateManager keeps a ca and serving certificate in a Secret and the
+// ca bundle of the webhook configuration up to date. Only the leader writes,
+// every replica serves the certificate from the Secret.
+type CertificateManager struct {
+	client    *KubeClient
+	options   CertificateOptions
+	namespace string
+	elector   *LeaderElector
+}
+
+func NewCertificateManager(client *KubeClient, options CertificateOptions, namespace string, elector *LeaderElector) *CertificateManager {
+	return &CertificateManager{
+		client:    client,
+		options:   options,
+		namespace: namespace,
+		elector:   elector,
+	}
+}
+
+func (m *CertificateManager) getSecretPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", m.namespace, m.options.SecretName)
+}
+
+func (m *CertificateManager) getSecret(ctx context.Context) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	err := m.client.Get(ctx, m.getSecretPath(), &secret)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not get certificate secret %s/%s: %v", m.namespace, m.options.SecretName, err)
+	}
+	return &secret, nil
+}
+
+// getCertificateAuthority returns the current ca and the bundle of cas that
+// are still trusted, or nils if the secret has no usable ca
+func getCertificateAuthority(secret *corev1.Secret) (*x509.Certificate, crypto.Signer, []*x509.Certificate) {
+	if secret == nil {
+		return nil, nil, nil
+	}
+
+	caBundle, err := parseCertificatesPEM(secret.Data[certificateSecretCABundleKey])
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	caKey, err := parsePrivateKeyPEM(secret.Data[certificateSecretCAKey])
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	// certificates signed with a key that does not belong to the ca would
+	// not be trusted
+	caPublicKey, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !caPublicKey.Equal(caBundle[0].PublicKey) {
+		return nil, nil, nil
+	}
+
+	return caBundle[0], caKey, caBundle
+}
+
+// needsServingCertificate reports whether the serving certificate in the
+// secret is missing, does not match its key, expires soon, is not trusted by
+// the ca bundle or does not cover dnsNames
+func (m *CertificateManager) needsServingCertificate(secret *corev1.Secret, caBundle []*x509.Certificate, dnsNames []string) bool {
+	if secret == nil {
+		return true
+	}
+
+	certificates, err := parseCertificatesPEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return true
+	}
+	if _, err := parsePrivateKeyPEM(secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return true
+	}
+	// a mismatched or half written pair would fail every handshake
+	if _, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return true
+	}
+
+	certificate := certificates[0]
+	if time.Until(certificate.NotAfter) < days(m.options.RenewBeforeDays) {
+		return true
+	}
+
+	if !slices.Equal(certificate.DNSNames, dnsNames) {
+		return true
+	}
+
+	for _, ca := range caBundle {
+		if certificate.CheckSignatureFrom(ca) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcile rotates what needs rotating and makes sure the webhook
+// configuration trusts the ca bundle. A new ca is added to the bundle next to
+// the old one, and the serving certificate signed by the old ca is kept until
+// it is due for renewal, so api servers that still have the old bundle keep
+// trusting the webhook.
+func (m *CertificateManager) reconcile(ctx context.Context) error {
+	secret, err := m.getSecret(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := map[string][]byte{}
+	if secret != nil {
+		for key, value := range secret.Data {
+			data[key] = value
+		}
+	}
+
+	ca, caKey, caBundle := getCertificateAuthority(secret)
+	if ca == nil || time.Until(ca.NotAfter) < days(m.options.ValidityDays+m.options.RenewBeforeDays) {
+		newCAKey, err := generatePrivateKey(keyTypeECDSA, 0)
+		if err != nil {
+			return err
+		}
+
+		newCA, err := generateCertificateAuthority(m.options.ServiceName+"-ca", days(m.options.CAValidityDays), newCAKey)
+		if err != nil {
+			return err
+		}
+
+		caKeyPEM, err := encodePrivateKeyPEM(newCAKey)
+		if err != nil {
+			return err
+		}
+
+		ca, caKey, caBundle = newCA, newCAKey, append([]*x509.Certificate{newCA}, caBundle...)
+		data[certificateSecretCAKey] = caKeyPEM
+		slog.Info("Generated certificate authority", "expiry", ca.NotAfter)
+	}
+
+	// expired cas are dropped from the bundle
+	caBundle = slices.DeleteFunc(caBundle[1:], func(oldCA *x509.Certificate) bool {
+		return time.Now().After(oldCA.NotAfter)
+	})
+	caBundle = append([]*x509.Certificate{ca}, caBundle...)
+
+	caBundlePEM := []byte{}
+	for _, bundledCA := range caBundle {
+		caBundlePEM = append(caBundlePEM, encodeCertificatePEM(bundledCA)...)
+	}
+	data[certificateSecretCABundleKey] = caBundlePEM
+
+	dnsNames := getServiceDNSNames(m.options.ServiceName, m.namespace, m.options.ClusterDomain)
+	if m.needsServingCertificate(secret, caBundle, dnsNames) {
+		key, err := generatePrivateKey(keyTypeECDSA, 0)
+		if err != nil {
+			return err
+		}
+
+		certificate, err := generateServingCertificate(ca, caKey, dnsNames, nil, days(m.options.ValidityDays), key)
+		if err != nil {
+			return err
+		}
+
+		keyPEM, err := encodePrivateKeyPEM(key)
+		if err != nil {
+			return err
+		}
+
+		data[corev1.TLSCertKey] = encodeCertificatePEM(certificate)
+		data[corev1.TLSPrivateKeyKey] = keyPEM
+		slog.Info("Generated serving certificate", "dnsNames", dnsNames, "expiry", certificate.NotAfter)
+	}
+
+	if err := m.writeSecret(ctx, secret, data); err != nil {
+		return err
+	}
+
+	return m.patchCABundle(ctx, caBundlePEM)
+}
+
+func (m *CertificateManager) writeSecret(ctx context.Context, secret *corev1.Secret, data map[string][]byte) error {
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.options.SecretName,
+				Namespace: m.namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: data,
+		}
+
+		if err := m.client.Create(ctx, fmt.Sprintf("/api/v1/namespaces/%s/secrets", m.namespace), secret); err != nil {
+			return fmt.Errorf("Could not create certificate secret %s/%s: %v", m.namespace, m.options.SecretName, err)
+		}
+		return nil
+	}
+
+	changed := len(data) != len(secret.Data)
+	for key, value := range data {
+		if !bytes.Equal(value, secret.Data[key]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	secret.Data = data
+	if err := m.client.Update(ctx, m.getSecretPath(), secret); err != nil {
+		return fmt.Errorf("Could not update certificate secret %s/%s: %v", m.namespace, m.options.SecretName, err)
+	}
+	return nil
+}
+
+func (m *CertificateManager) patchCABundle(ctx context.Context, caBundlePEM []byte) error {
+	webhookConfigurationPath := "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/" + m.options.WebhookConfigurationName
+
+	var webhookConfiguration admissionregistrationv1.MutatingWebhookConfiguration
+	if err := m.client.Get(ctx, webhookConfigurationPath, &webhookConfiguration); err != nil {
+		return fmt.Errorf("Could not get webhook configuration %s: %v", m.options.WebhookConfigurationName, err)
+	}
+
+	needsPatch := false
+	for _, webhook := range webhookConfiguration.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, caBundlePEM) {
+			needsPatch = true
+		}
+	}
+	if !needsPatch {
+		return nil
+	}
+
+	// the names are tested first, so a patch computed from a stale list of
+	// webhooks fails instead of updating the wrong one. add replaces an
+	// existing caBundle, and []byte is base64 encoded as the api expects.
+	patches := make([]map[string]interface{}, 0, 2*len(webhookConfiguration.Webhooks))
+	for index, webhook := range webhookConfiguration.Webhooks {
+		patches = append(patches, map[string]interface{}{
+			"op":    "test",
+			"path":  fmt.Sprintf("/webhooks/%d/name", index),
+			"value": webhook.Name,
+		}, map[string]interface{}{
+			"op":    "add",
+			"path":  fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", index),
+			"value": caBundlePEM,
+		})
+	}
+
+	patchBytes, err := json.Marshal(patches)
+	if err != nil {
+		return fmt.Errorf("Could not marshal webhook configuration patch into bytes -- possible formatting error: %v", err)
+	}
+
+	if err := m.client.Patch(ctx, webhookConfigurationPath, "application/json-patch+json", patchBytes); err != nil {
+		return fmt.Errorf("Could not patch ca bundle of webhook configuration %s: %v", m.options.WebhookConfigurationName, err)
+	}
+
+	slog.Info("Patched ca bundle of webhook configuration", "webhookConfiguration", m.options.WebhookConfigurationName)
+	return nil
+}
+
+// Run reconciles the certificates while this replica is the leader, until
+// ctx is cancelled. A new leader reconciles right away instead of waiting for
+// the next interval.
+func (m *CertificateManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(leaseRenewPeriod)
+	defer ticker.Stop()
+
+	wasLeader := false
+	lastReconcile := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		isLeader := m.elector.IsLeader()
+		becameLeader := isLeader && !wasLeader
+		wasLeader = isLeader
+		if !isLeader || (!becameLeader && time.Since(lastReconcile) < certificateReconcileInterval) {
+			continue
+		}
+
+		lastReconcile = time.Now()
+		if err := m.reconcile(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Could not reconcile self managed certificates", "error", err)
+		}
+	}
+}
+
+// startCertificateManager starts leader election and the certificate
+// manager, and returns a reloader serving the certificate from the Secret
+func startCertificateManager(ctx context.Context, client *KubeClient, certificateOptions *CertificateOptions, expiryWarningDays int) (*CertificateReloader, error) {
+	namespace := certificateOptions.Namespace
+	if namespace == "" {
+		var err error
+		namespace, err = getInClusterNamespace()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	elector := NewLeaderElector(client, namespace, certificateOptions.LeaseName)
+	go elector.Run(ctx)
+
+	manager := NewCertificateManager(client, *certificateOptions, namespace, elector)
+	go manager.Run(ctx)
+
+	return NewSecretCertificateReloader(client, namespace, certificateOptions.SecretName, expiryWarningDays), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeObjectServer stores objects as json by path and handles the requests
+// of KubeClient like the api server
+type fakeObjectServer struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	writes  map[string]int
+}
+
+func (s *fakeObjectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	objectPath := r.URL.Path
+	switch r.Method {
+	case http.MethodPost:
+		var object struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal(body, &object)
+		objectPath = path.Join(r.URL.Path, object.Metadata.Name)
+		if _, ok := s.objects[objectPath]; ok {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+	case http.MethodPut, http.MethodPatch, http.MethodGet:
+		if _, ok := s.objects[objectPath]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		var patch []map[string]interface{}
+		json.Unmarshal(body, &patch)
+		patched, err := applyJSONPatch(s.objects[objectPath], patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		body = patched
+	case http.MethodGet:
+		w.Write(s.objects[objectPath])
+		return
+	}
+
+	s.objects[objectPath] = body
+	s.writes[objectPath]++
+	w.Write(body)
+}
+
+func (s *fakeObjectServer) get(t *testing.T, objectPath string, out interface{}) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := json.Unmarshal(s.objects[objectPath], out); err != nil {
+		t.Fatalf("Could not decode %s: %v", objectPath, err)
+	}
+}
+
+func (s *fakeObjectServer) put(t *testing.T, objectPath string, object interface{}) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	objectBytes, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.objects[objectPath] = objectBytes
+}
+
+const (
+	testSecretPath               = "/api/v1/namespaces/system/secrets/webhook-tls"
+	testWebhookConfigurationPath = "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/webhook"
+)
+
+func newTestCertificateManager(t *testing.T) (*CertificateManager, *fakeObjectServer) {
+	objectServer := &fakeObjectServer{objects: map[string][]byte{}, writes: map[string]int{}}
+	server := httptest.NewServer(objectServer)
+	t.Cleanup(server.Close)
+
+	objectServer.put(t, testWebhookConfigurationPath, admissionregistrationv1.MutatingWebhookConfiguration{
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{Name: "mutate-pod.example.com"}, {Name: "mutate-statefulset.example.com"}},
+	})
+
+	client := &KubeClient{BaseURL: server.URL, HTTPClient: server.Client()}
+	options := CertificateOptions{
+		SelfManaged:              true,
+		SecretName:               "webhook-tls",
+		LeaseName:                "webhook",
+		WebhookConfigurationName: "webhook",
+		ServiceName:              "webhook",
+		ClusterDomain:            "cluster.local",
+		CAValidityDays:           3650,
+		ValidityDays:             365,
+		RenewBeforeDays:          30,
+	}
+	return NewCertificateManager(client, options, "system", nil), objectServer
+}
+
+// getTestCertificates returns the serving certificate and ca bundle of the
+// secret and checks that the pair matches, the certificate is trusted and
+// the webhook configuration has the bundle
+func getTestCertificates(t *testing.T, objectServer *fakeObjectServer) (*x509.Certificate, []*x509.Certificate) {
+	t.Helper()
+	var secret corev1.Secret
+	objectServer.get(t, testSecretPath, &secret)
+
+	if _, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		t.Fatalf("The serving certificate does not match its key: %v", err)
+	}
+	certificates, err := parseCertificatesPEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	caBundle, err := parseCertificatesPEM(secret.Data[certificateSecretCABundleKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, ca := range caBundle {
+		roots.AddCert(ca)
+	}
+	if _, err := certificates[0].Verify(x509.VerifyOptions{DNSName: "webhook.system.svc", Roots: roots}); err != nil {
+		t.Errorf("The serving certificate is not trusted by the ca bundle: %v", err)
+	}
+
+	var webhookConfiguration admissionregistrationv1.MutatingWebhookConfiguration
+	objectServer.get(t, testWebhookConfigurationPath, &webhookConfiguration)
+	for _, webhook := range webhookConfiguration.Webhooks {
+		if string(webhook.ClientConfig.CABundle) != string(secret.Data[certificateSecretCABundleKey]) {
+			t.Errorf("Webhook %s does not have the ca bundle of the secret", webhook.Name)
+		}
+	}
+	return certificates[0], caBundle
+}
+
+func TestCertificateManagerReconcile(t *testing.T) {
+	manager, objectServer := newTestCertificateManager(t)
+	ctx := context.Background()
+
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	certificate, caBundle := getTestCertificates(t, objectServer)
+	if len(caBundle) != 1 {
+		t.Errorf("Expected one ca, got %d", len(caBundle))
+	}
+	expectedDNSNames := []string{"webhook", "webhook.system", "webhook.system.svc", "webhook.system.svc.cluster.local"}
+	assertJSONEqual(t, certificate.DNSNames, expectedDNSNames)
+
+	// nothing is written while the certificates are fine
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if writes := objectServer.writes[testSecretPath]; writes != 1 {
+		t.Errorf("Expected the secret to be written once, got %d", writes)
+	}
+	if writes := objectServer.writes[testWebhookConfigurationPath]; writes != 1 {
+		t.Errorf("Expected the ca bundle to be patched once, got %d", writes)
+	}
+}
+
+func TestCertificateManagerReissuesServingCertificate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, manager *CertificateManager, secret *corev1.Secret)
+	}{
+		{
+			name: "mismatched key",
+			modify: func(t *testing.T, manager *CertificateManager, secret *corev1.Secret) {
+				key, _ := generatePrivateKey(keyTypeECDSA, 0)
+				secret.Data[corev1.TLSPrivateKeyKey], _ = encodePrivateKeyPEM(key)
+			},
+		},
+		{
+			name: "half written certificate",
+			modify: func(t *testing.T, manager *CertificateManager, secret *corev1.Secret) {
+				secret.Data[corev1.TLSCertKey] = secret.Data[corev1.TLSCertKey][:len(secret.Data[corev1.TLSCertKey])/2]
+			},
+		},
+		{
+			name: "expires soon",
+			modify: func(t *testing.T, manager *CertificateManager, secret *corev1.Secret) {
+				manager.options.RenewBeforeDays = 400
+			},
+		},
+		{
+			name: "service renamed",
+			modify: func(t *testing.T, manager *CertificateManager, secret *corev1.Secret) {
+				manager.options.ServiceName = "webhook-v2"
+			},
+		},
+		{
+			name: "signed by an unknown ca",
+			modify: func(t *testing.T, manager *CertificateManager, secret *corev1.Secret) {
+				caKey, _ := generatePrivateKey(keyTypeECDSA, 0)
+				ca, _ := generateCertificateAuthority("other-ca", days(10), caKey)
+				key, _ := generatePrivateKey(keyTypeECDSA, 0)
+				certificate, _ := generateServingCertificate(ca, caKey, getServiceDNSNames("webhook", "system", "cluster.local"), nil, days(365), key)
+				secret.Data[corev1.TLSCertKey] = encodeCertificatePEM(certificate)
+				secret.Data[corev1.TLSPrivateKeyKey], _ = encodePrivateKeyPEM(key)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manager, objectServer := newTestCertificateManager(t)
+			ctx := context.Background()
+			if err := manager.reconcile(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var secret corev1.Secret
+			objectServer.get(t, testSecretPath, &secret)
+			oldCABundle := string(secret.Data[certificateSecretCABundleKey])
+
+			test.modify(t, manager, &secret)
+			objectServer.put(t, testSecretPath, &secret)
+			if err := manager.reconcile(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if manager.options.ServiceName == "webhook" {
+				getTestCertificates(t, objectServer)
+			}
+			objectServer.get(t, testSecretPath, &secret)
+			if objectServer.writes[testSecretPath] != 2 {
+				t.Errorf("Expected a new serving certificate, got %d writes", objectServer.writes[testSecretPath])
+			}
+			if _, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+				t.Errorf("The new serving certificate does not match its key: %v", err)
+			}
+			if string(secret.Data[certificateSecretCABundleKey]) != oldCABundle {
+				t.Error("Expected the ca to be kept")
+			}
+		})
+	}
+}
+
+func TestCertificateManagerRotatesCA(t *testing.T) {
+	manager, objectServer := newTestCertificateManager(t)
+	ctx := context.Background()
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	oldCertificate, oldCABundle := getTestCertificates(t, objectServer)
+
+	// the ca can no longer sign a full serving certificate, so a new one is
+	// added in front, and the serving certificate of the old one is kept
+	manager.options.CAValidityDays = 3650
+	manager.options.ValidityDays = 3650
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	certificate, caBundle := getTestCertificates(t, objectServer)
+	if len(caBundle) != 2 || !caBundle[1].Equal(oldCABundle[0]) {
+		t.Fatalf("Expected the new ca in front of the old one, got %d cas", len(caBundle))
+	}
+	if !certificate.Equal(oldCertificate) {
+		t.Error("Expected the serving certificate of the old ca to be kept")
+	}
+
+	// expired cas are dropped from the bundle
+	var secret corev1.Secret
+	objectServer.get(t, testSecretPath, &secret)
+	expiredCAKey, _ := generatePrivateKey(keyTypeECDSA, 0)
+	expiredCA, err := generateCertificateAuthority("expired-ca", -30*time.Minute, expiredCAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[certificateSecretCABundleKey] = append(secret.Data[certificateSecretCABundleKey], encodeCertificatePEM(expiredCA)...)
+	objectServer.put(t, testSecretPath, &secret)
+
+	manager.options.ValidityDays = 365
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, caBundle = getTestCertificates(t, objectServer)
+	if len(caBundle) != 2 {
+		t.Errorf("Expected the expired ca to be dropped, got %d cas", len(caBundle))
+	}
+}
+
+func TestCertificateManagerReplacesCAWithMismatchedKey(t *testing.T) {
+	manager, objectServer := newTestCertificateManager(t)
+	ctx := context.Background()
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, oldCABundle := getTestCertificates(t, objectServer)
+
+	var secret corev1.Secret
+	objectServer.get(t, testSecretPath, &secret)
+	caKey, _ := generatePrivateKey(keyTypeECDSA, 0)
+	secret.Data[certificateSecretCAKey], _ = encodePrivateKeyPEM(caKey)
+	objectServer.put(t, testSecretPath, &secret)
+
+	if err := manager.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, caBundle := getTestCertificates(t, objectServer)
+	if len(caBundle) != 1 || caBundle[0].Equal(oldCABundle[0]) {
+		t.Errorf("Expected a new ca, got %d cas", len(caBundle))
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	configErrorPolicyDeny   = "Deny"
+	configErrorPolicyIgnore = "Ignore"
+
+	configPollInterval = 10 * time.Second
+)
+
+// MutationOptions are read for every admission request, so unlike the rest
+// of the server config they take effect on reload
+type MutationOptions struct {
+	// prefix of the annotations the webhook reads and writes, every
+	// instance running in the same cluster needs its own
+	AnnotationDomain string `json:"annotationDomain"`
+
+	// what to do with objects whose mutation config can not be resolved,
+	// Deny rejects them and Ignore admits them without a patch
+	ConfigErrorPolicy string `json:"configErrorPolicy"`
+
+	// how to answer requests the webhook fails to handle in time or at
+	// all, Fail denies them and Ignore admits them without a patch, like
+	// the failurePolicy of the webhook configuration
+	FailurePolicy string `json:"failurePolicy"`
+
+	// compute mutations without applying them, objects are admitted with
+	// only the shadow-result annotation describing what would have happened
+	Shadow bool `json:"shadow"`
+}
+
+type ServerConfig struct {
+	Server   ServerOptions   `json:"server"`
+	Caches   CacheOptions    `json:"caches"`
+	Mutation MutationOptions `json:"mutation"`
+	Policy   PolicyOptions   `json:"policy"`
+	Logging  LogOptions      `json:"logging"`
+	Events   EventOptions    `json:"events"`
+	Tracing  TracingOptions  `json:"tracing"`
+	// self managed certificates
+	Certificates CertificateOptions `json:"certificates"`
+}
+
+// stringListFlag is a comma separated list flag
+type stringListFlag struct {
+	values *[]string
+}
+
+func (f stringListFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f stringListFlag) Set(value string) error {
+	*f.values = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.values = append(*f.values, item)
+		}
+	}
+	return nil
+}
+
+var currentServerConfig atomic.Pointer[ServerConfig]
+
+// getServerConfig returns the config in use. Handlers should call it once
+// per request so a reload can not change the config halfway through.
+func getServerConfig() *ServerConfig {
+	return currentServerConfig.Load()
+}
+
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Server: ServerOptions{
+			HTTPAddress:                  ":8080",
+			HTTPSAddress:                 ":8443",
+			CertFile:                     "./secrets/certs/tls.crt",
+			KeyFile:                      "./secrets/certs/tls.key",
+			GracefulShutdownSeconds:      5,
+			ShutdownDrainSeconds:         5,
+			CertificateExpiryWarningDays: 30,
+			TLSMinVersion:                tlsVersion12,
+			ReadHeaderTimeoutSeconds:     10,
+			ReadTimeoutSeconds:           30,
+			WriteTimeoutSeconds:          35,
+			IdleTimeoutSeconds:           120,
+			MaxRequestBodyBytes:          4 << 20,
+		},
+		Caches: CacheOptions{
+			SyncTimeoutSeconds: 60,
+		},
+		Mutation: MutationOptions{
+			AnnotationDomain:  defaultAnnotationDomain,
+			ConfigErrorPolicy: configErrorPolicyDeny,
+			FailurePolicy:     failurePolicyFail,
+		},
+		Policy: PolicyOptions{
+			ExcludedNamespaces: []string{"kube-system"},
+		},
+		Logging: LogOptions{
+			Format: logFormatJSON,
+			Level:  "info",
+		},
+		Events: EventOptions{
+			PodEventDelaySeconds: 5,
+			BurstPerObject:       25,
+			RefillSeconds:        300,
+		},
+		Certificates: CertificateOptions{
+			LeaseName:       "statefulset-affinity-injector",
+			ClusterDomain:   "cluster.local",
+			CAValidityDays:  3650,
+			ValidityDays:    365,
+			RenewBeforeDays: 30,
+		},
+		Tracing: TracingOptions{
+			ServiceName:           "statefulset-affinity-injector",
+			SamplingRatio:         1,
+			ExportIntervalSeconds: 5,
+		},
+	}
+}
+
+// newServerFlagSet binds the command line flags to serverConfig, using its
+// current values as defaults, so parsing only overrides flags that are set
+func newServerFlagSet(errorHandling flag.ErrorHandling, serverConfig *ServerConfig, configFile *string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(os.Args[0], errorHandling)
+	flagSet.StringVar(configFile, "config", "", "filepath to a yaml or json server config file, reloaded on SIGHUP or when it changes")
+
+	flagSet.BoolVar(&serverConfig.Server.EnableTLS, "enable-tls", serverConfig.Server.EnableTLS, "whether or not to enable TLS")
+	flagSet.StringVar(&serverConfig.Server.CertFile, "cert-file", serverConfig.Server.CertFile, "filepath to .crt file, ignored if tls is not enabled")
+	flagSet.StringVar(&serverConfig.Server.KeyFile, "key-file", serverConfig.Server.KeyFile, "filepath to .key file, ignored if tls is not enabled")
+	flagSet.StringVar(&serverConfig.Server.HTTPAddress, "http-address", serverConfig.Server.HTTPAddress, "address to listen on if tls is not enabled")
+	flagSet.StringVar(&serverConfig.Server.HTTPSAddress, "https-address", serverConfig.Server.HTTPSAddress, "address to listen on if tls is enabled")
+	flagSet.StringVar(&serverConfig.Server.ClientCAFile, "client-ca-file", serverConfig.Server.ClientCAFile, "filepath to a CA bundle client certificates are verified against, client certificates are not required if empty")
+	flagSet.Var(stringListFlag{&serverConfig.Server.AllowedClientNames}, "allowed-client-names", "comma separated common or dns names of allowed client certificates, any verified client certificate is allowed if empty")
+	flagSet.StringVar(&serverConfig.Server.HealthAddress, "health-address", serverConfig.Server.HealthAddress, "address to serve /status and /metrics on over plain http, they are served on the main address if empty")
+	flagSet.StringVar(&serverConfig.Server.TLSMinVersion, "tls-min-version", serverConfig.Server.TLSMinVersion, "minimum tls version, 1.2 or 1.3")
+	flagSet.Var(stringListFlag{&serverConfig.Server.TLSCipherSuites}, "tls-cipher-suites", "comma separated names of the tls 1.2 cipher suites to accept, go's defaults if empty")
+	flagSet.IntVar(&serverConfig.Server.ReadHeaderTimeoutSeconds, "read-header-timeout-seconds", serverConfig.Server.ReadHeaderTimeoutSeconds, "number of seconds to wait for request headers")
+	flagSet.IntVar(&serverConfig.Server.ReadTimeoutSeconds, "read-timeout-seconds", serverConfig.Server.ReadTimeoutSeconds, "number of seconds to wait for a whole request")
+	flagSet.IntVar(&serverConfig.Server.WriteTimeoutSeconds, "write-timeout-seconds", serverConfig.Server.WriteTimeoutSeconds, "number of seconds after reading the request headers to finish writing the response")
+	flagSet.IntVar(&serverConfig.Server.IdleTimeoutSeconds, "idle-timeout-seconds", serverConfig.Server.IdleTimeoutSeconds, "number of seconds to keep idle connections open")
+	flagSet.Int64Var(&serverConfig.Server.MaxRequestBodyBytes, "max-request-body-bytes", serverConfig.Server.MaxRequestBodyBytes, "maximum size of admission review requests")
+	flagSet.IntVar(&serverConfig.Server.CertificateExpiryWarningDays, "certificate-expiry-warning-days", serverConfig.Server.CertificateExpiryWarningDays, "number of days before the certificate expires to start logging warnings")
+	flagSet.IntVar(&serverConfig.Server.ShutdownDrainSeconds, "shutdown-drain-seconds", serverConfig.Server.ShutdownDrainSeconds, "number of seconds /readyz fails before the server shuts down")
+	flagSet.IntVar(&serverConfig.Server.GracefulShutdownSeconds, "graceful-shutdown-seconds", serverConfig.Server.GracefulShutdownSeconds, "number of seconds to wait before graceful shutdown")
+
+	flagSet.BoolVar(&serverConfig.Caches.EnableNamespaceDefaults, "enable-namespace-defaults", serverConfig.Caches.EnableNamespaceDefaults, "whether or not to read default configs from namespace annotations, requires list and watch access to namespaces")
+	flagSet.BoolVar(&serverConfig.Caches.EnableConfigMapReferences, "enable-configmap-references", serverConfig.Caches.EnableConfigMapReferences, "whether or not to resolve configmap references in config annotations, requires list and watch access to configmaps")
+	flagSet.StringVar(&serverConfig.Caches.ConfigMapLabelSelector, "configmap-label-selector", serverConfig.Caches.ConfigMapLabelSelector, "label selector limiting which configmaps are cached and can be referenced")
+	flagSet.Var(stringListFlag{&serverConfig.Caches.ConfigMapNamespaces}, "configmap-namespaces", "comma separated namespaces whose configmaps are cached and can be referenced from any namespace, by default configmaps can only be referenced from their own namespace")
+	flagSet.IntVar(&serverConfig.Caches.SyncTimeoutSeconds, "cache-sync-timeout-seconds", serverConfig.Caches.SyncTimeoutSeconds, "number of seconds to wait for caches to sync at startup")
+
+	flagSet.StringVar(&serverConfig.Mutation.AnnotationDomain, "annotation-domain", serverConfig.Mutation.AnnotationDomain, "prefix of the annotations the webhook reads and writes")
+	flagSet.StringVar(&serverConfig.Mutation.ConfigErrorPolicy, "config-error-policy", serverConfig.Mutation.ConfigErrorPolicy, "what to do with objects whose config can not be resolved, Deny or Ignore")
+	flagSet.StringVar(&serverConfig.Mutation.FailurePolicy, "failure-policy", serverConfig.Mutation.FailurePolicy, "how to answer requests that fail or time out, Fail or Ignore")
+	flagSet.BoolVar(&serverConfig.Mutation.Shadow, "shadow", serverConfig.Mutation.Shadow, "compute mutations without applying them")
+
+	flagSet.Var(stringListFlag{&serverConfig.Policy.ExcludedNamespaces}, "excluded-namespaces", "comma separated namespaces whose objects are never mutated")
+	flagSet.Var(stringListFlag{&serverConfig.Policy.AllowedKeys}, "allowed-keys", "comma separated node label keys configs may use, all keys are allowed if empty")
+
+	flagSet.StringVar(&serverConfig.Logging.Format, "log-format", serverConfig.Logging.Format, "log format, json or text")
+	flagSet.StringVar(&serverConfig.Logging.Level, "log-level", serverConfig.Logging.Level, "minimum log level, debug, info, warn or error")
+
+	flagSet.BoolVar(&serverConfig.Events.Enabled, "enable-events", serverConfig.Events.Enabled, "whether or not to post events on statefulsets, requires create and patch access to events")
+	flagSet.BoolVar(&serverConfig.Events.PodEvents, "enable-pod-events", serverConfig.Events.PodEvents, "whether or not to also post events on pods after they are created")
+
+	flagSet.BoolVar(&serverConfig.Certificates.SelfManaged, "self-managed-certificates", serverConfig.Certificates.SelfManaged, "whether or not to generate and rotate certificates in a secret instead of reading cert-file and key-file, requires tls")
+	flagSet.StringVar(&serverConfig.Certificates.SecretName, "certificate-secret", serverConfig.Certificates.SecretName, "name of the secret self managed certificates are stored in")
+	flagSet.StringVar(&serverConfig.Certificates.LeaseName, "leader-election-lease", serverConfig.Certificates.LeaseName, "name of the lease used to elect the replica that manages certificates")
+	flagSet.StringVar(&serverConfig.Certificates.WebhookConfigurationName, "webhook-configuration", serverConfig.Certificates.WebhookConfigurationName, "name of the mutating webhook configuration whose ca bundle is patched")
+	flagSet.StringVar(&serverConfig.Certificates.ServiceName, "service-name", serverConfig.Certificates.ServiceName, "name of the webhook service the serving certificate is valid for")
+	flagSet.StringVar(&serverConfig.Certificates.ClusterDomain, "cluster-domain", serverConfig.Certificates.ClusterDomain, "cluster domain used in the dns names of the serving certificate")
+
+	flagSet.BoolVar(&serverConfig.Tracing.Enabled, "enable-tracing", serverConfig.Tracing.Enabled, "whether or not to export traces of admission requests")
+	flagSet.StringVar(&serverConfig.Tracing.Endpoint, "tracing-endpoint", serverConfig.Tracing.Endpoint, "base url of the otlp/http collector traces are exported to")
+	flagSet.Float64Var(&serverConfig.Tracing.SamplingRatio, "tracing-sampling-ratio", serverConfig.Tracing.SamplingRatio, "fraction of admission requests that are traced when the api server did not sample them")
+
+	return flagSet
+}
+
+// yaml.v2 decodes maps with interface{} keys, which encoding/json can not
+// marshal, so they are converted before the yaml is turned into json
+func convertYAMLToJSONValue(value interface{}) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			stringKey, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", key)
+			}
+
+			convertedItem, err := convertYAMLToJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[stringKey] = convertedItem
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(typedValue))
+		for index, item := range typedValue {
+			convertedItem, err := convertYAMLToJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[index] = convertedItem
+		}
+		return converted, nil
+	default:
+		return value, nil
+	}
+}
+
+// json is valid yaml, so both formats are decoded the same way
+func yamlToJSON(yamlBytes []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(yamlBytes, &value); err != nil {
+		return nil, err
+	}
+
+	converted, err := convertYAMLToJSONValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(converted)
+}
+
+// loadServerConfig reads the config file on top of the defaults and then
+// applies the command line flags, so flags always win over the file
+func loadServerConfig(configFile string, args []string) (*ServerConfig, error) {
+	serverConfig := defaultServerConfig()
+
+	if configFile != "" {
+		configBytes, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read config file %s: %v", configFile, err)
+		}
+
+		configJSON, err := yamlToJSON(configBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse config file %s: %v", configFile, err)
+		}
+
+		// an empty file decodes to null, which leaves the defaults untouched
+		decoder := json.NewDecoder(bytes.NewReader(configJSON))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(serverConfig); err != nil {
+			return nil, fmt.Errorf("Could not parse config file %s: %v", configFile, err)
+		}
+	}
+
+	var ignoredConfigFile string
+	if err := newServerFlagSet(flag.ContinueOnError, serverConfig, &ignoredConfigFile).Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := serverConfig.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid server config: %v", err)
+	}
+
+	return serverConfig, nil
+}
+
+func (c *ServerConfig) validate() error {
+	if c.Certificates.SelfManaged && !c.Server.EnableTLS {
+		return fmt.Errorf("server.enableTLS is required for self managed certificates")
+	}
+
+	if c.Server.EnableTLS && !c.Certificates.SelfManaged && (c.Server.CertFile == "" || c.Server.KeyFile == "") {
+		return fmt.Errorf("server.certFile and server.keyFile are required when tls is enabled")
+	}
+
+	if c.Server.ClientCAFile != "" && !c.Server.EnableTLS {
+		return fmt.Errorf("server.enableTLS is required to verify client certificates")
+	}
+
+	// probes can not present a client certificate
+	if c.Server.ClientCAFile != "" && c.Server.HealthAddress == "" {
+		return fmt.Errorf("server.healthAddress is required to verify client certificates")
+	}
+
+	if len(c.Server.AllowedClientNames) > 0 && c.Server.ClientCAFile == "" {
+		return fmt.Errorf("server.clientCAFile is required for server.allowedClientNames")
+	}
+
+	addresses := []struct{ name, address string }{
+		{"httpAddress", c.Server.HTTPAddress},
+		{"httpsAddress", c.Server.HTTPSAddress},
+		{"healthAddress", c.Server.HealthAddress},
+	}
+	for _, address := range addresses {
+		if address.address == "" && address.name == "healthAddress" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address.address); err != nil {
+			return fmt.Errorf("server.%s %q is not a valid address, ipv6 addresses need brackets: %v", address.name, address.address, err)
+		}
+	}
+
+	if _, err := parseTLSVersion(c.Server.TLSMinVersion); err != nil {
+		return err
+	}
+
+	if _, err := parseCipherSuites(c.Server.TLSCipherSuites); err != nil {
+		return err
+	}
+
+	if c.Server.ReadHeaderTimeoutSeconds <= 0 || c.Server.ReadTimeoutSeconds <= 0 || c.Server.WriteTimeoutSeconds <= 0 || c.Server.IdleTimeoutSeconds <= 0 {
+		return fmt.Errorf("server timeouts must be positive")
+	}
+
+	if c.Server.MaxRequestBodyBytes <= 0 {
+		return fmt.Errorf("server.maxRequestBodyBytes must be positive")
+	}
+
+	if c.Server.CertificateExpiryWarningDays < 0 {
+		return fmt.Errorf("server.certificateExpiryWarningDays can not be negative")
+	}
+
+	if c.Server.ShutdownDrainSeconds < 0 {
+		return fmt.Errorf("server.shutdownDrainSeconds can not be negative")
+	}
+
+	if c.Server.GracefulShutdownSeconds < 0 {
+		return fmt.Errorf("server.gracefulShutdownSeconds can not be negative")
+	}
+
+	if c.Caches.SyncTimeoutSeconds <= 0 {
+		return fmt.Errorf("caches.syncTimeoutSeconds must be positive")
+	}
+
+	if errs := validation.IsDNS1123Subdomain(c.Mutation.AnnotationDomain); len(errs) > 0 {
+		return fmt.Errorf("mutation.annotationDomain %q is not a valid annotation prefix: %s", c.Mutation.AnnotationDomain, strings.Join(errs, ", "))
+	}
+
+	if c.Mutation.ConfigErrorPolicy != configErrorPolicyDeny && c.Mutation.ConfigErrorPolicy != configErrorPolicyIgnore {
+		return fmt.Errorf("mutation.configErrorPolicy must be %s or %s, got %q", configErrorPolicyDeny, configErrorPolicyIgnore, c.Mutation.ConfigErrorPolicy)
+	}
+
+	if c.Mutation.FailurePolicy != failurePolicyFail && c.Mutation.FailurePolicy != failurePolicyIgnore {
+		return fmt.Errorf("mutation.failurePolicy must be %s or %s, got %q", failurePolicyFail, failurePolicyIgnore, c.Mutation.FailurePolicy)
+	}
+
+	if err := c.Logging.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Events.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Certificates.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *ServerConfig) requiresRestart(oldServerConfig *ServerConfig) bool {
+	return !reflect.DeepEqual(c.Server, oldServerConfig.Server) ||
+		!reflect.DeepEqual(c.Caches, oldServerConfig.Caches) ||
+		!reflect.DeepEqual(c.Events, oldServerConfig.Events) ||
+		!reflect.DeepEqual(c.Tracing, oldServerConfig.Tracing) ||
+		!reflect.DeepEqual(c.Certificates, oldServerConfig.Certificates) ||
+		c.Logging.Format != oldServerConfig.Logging.Format
+}
+
+func reloadServerConfig(configFile string, args []string) {
+	serverConfig, err := loadServerConfig(configFile, args)
+	if err != nil {
+		slog.Error("Rejected config reload, keeping the old config", "file", configFile, "error", err)
+		return
+	}
+
+	// listeners, certificates, caches, the event recorder, the tracer and
+	// the log format are only set up at startup
+	oldServerConfig := getServerConfig()
+	if serverConfig.requiresRestart(oldServerConfig) {
+		slog.Warn("Changes to server, certificates, caches, events, tracing and log format settings require a restart and were not applied")
+		serverConfig.Server = oldServerConfig.Server
+		serverConfig.Caches = oldServerConfig.Caches
+		serverConfig.Events = oldServerConfig.Events
+		serverConfig.Tracing = oldServerConfig.Tracing
+		serverConfig.Certificates = oldServerConfig.Certificates
+		serverConfig.Logging.Format = oldServerConfig.Logging.Format
+	}
+
+	currentServerConfig.Store(serverConfig)
+	setLogLevel(&serverConfig.Logging)
+	slog.Info("Reloaded config", "file", configFile)
+}
+
+// watchServerConfig reloads the config file on SIGHUP and whenever its
+// content changes. The content is compared instead of the modification time
+// since mounted ConfigMaps are updated by swapping a symlink.
+func watchServerConfig(ctx context.Context, configFile string, args []string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastConfigBytes, _ := os.ReadFile(configFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("Received SIGHUP, reloading config")
+			lastConfigBytes, _ = os.ReadFile(configFile)
+			reloadServerConfig(configFile, args)
+		case <-ticker.C:
+			configBytes, err := os.ReadFile(configFile)
+			if err != nil || bytes.Equal(configBytes, lastConfigBytes) {
+				continue
+			}
+
+			lastConfigBytes = configBytes
+			reloadServerConfig(configFile, args)
+		}
+	}
+}
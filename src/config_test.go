@@ -0,0 +1,294 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		noConfigFile bool
+		config       string
+		args         []string
+		// changes to the default config
+		expect func(serverConfig *ServerConfig)
+	}{
+		{
+			name:         "no config file",
+			noConfigFile: true,
+		},
+		{
+			name:   "empty config file",
+			config: "",
+		},
+		{
+			name: "yaml config file",
+			config: `
+server:
+  httpAddress: ":9090"
+policy:
+  excludedNamespaces: [kube-system, monitoring]
+  allowedKeys: [topology.kubernetes.io/zone]
+mutation:
+  shadow: true
+logging:
+  level: debug
+`,
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Server.HTTPAddress = ":9090"
+				serverConfig.Policy.ExcludedNamespaces = []string{"kube-system", "monitoring"}
+				serverConfig.Policy.AllowedKeys = []string{"topology.kubernetes.io/zone"}
+				serverConfig.Mutation.Shadow = true
+				serverConfig.Logging.Level = "debug"
+			},
+		},
+		{
+			name:   "json config file",
+			config: `{"mutation": {"configErrorPolicy": "Ignore"}, "events": {"enabled": true}}`,
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Mutation.ConfigErrorPolicy = configErrorPolicyIgnore
+				serverConfig.Events.Enabled = true
+			},
+		},
+		{
+			name: "flags override the config file",
+			config: `
+server:
+  httpAddress: ":9090"
+mutation:
+  configErrorPolicy: Ignore
+policy:
+  excludedNamespaces: [monitoring]
+`,
+			args: []string{"-http-address", ":9191", "-excluded-namespaces", "kube-system,kube-public"},
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Server.HTTPAddress = ":9191"
+				serverConfig.Mutation.ConfigErrorPolicy = configErrorPolicyIgnore
+				serverConfig.Policy.ExcludedNamespaces = []string{"kube-system", "kube-public"}
+			},
+		},
+		{
+			name:   "ipv6 addresses and an empty health address",
+			config: "server:\n  httpAddress: \"[::1]:8080\"\n  httpsAddress: \"[::]:8443\"\n  healthAddress: \"\"\n",
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Server.HTTPAddress = "[::1]:8080"
+				serverConfig.Server.HTTPSAddress = "[::]:8443"
+			},
+		},
+		{
+			name: "flags without a config file",
+			args: []string{"-shadow", "-log-level", "warn"},
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Mutation.Shadow = true
+				serverConfig.Logging.Level = "warn"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var configFile string
+			if !test.noConfigFile {
+				configFile = writeTestConfigFile(t, test.config)
+			}
+
+			serverConfig, err := loadServerConfig(configFile, test.args)
+			if err != nil {
+				t.Fatalf("Could not load the config: %v", err)
+			}
+
+			expected := defaultServerConfig()
+			if test.expect != nil {
+				test.expect(expected)
+			}
+			assertJSONEqual(t, serverConfig, expected)
+		})
+	}
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		message string
+	}{
+		{
+			name:    "unknown field",
+			config:  "mutation:\n  shadowMode: true\n",
+			message: `unknown field "shadowMode"`,
+		},
+		{
+			name:    "wrong type",
+			config:  "server:\n  readTimeoutSeconds: thirty\n",
+			message: "Could not parse config file",
+		},
+		{
+			name:    "invalid yaml",
+			config:  "server: [",
+			message: "Could not parse config file",
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-shadow-mode"},
+			message: "flag provided but not defined",
+		},
+		{
+			name:    "invalid config error policy",
+			config:  "mutation:\n  configErrorPolicy: Allow\n",
+			message: `mutation.configErrorPolicy must be Deny or Ignore, got "Allow"`,
+		},
+		{
+			name:    "invalid annotation domain",
+			args:    []string{"-annotation-domain", "Not_A_Domain"},
+			message: `mutation.annotationDomain "Not_A_Domain" is not a valid annotation prefix`,
+		},
+		{
+			name:    "self managed certificates without tls",
+			config:  "certificates:\n  selfManaged: true\n",
+			message: "server.enableTLS is required for self managed certificates",
+		},
+		{
+			name:    "address without port",
+			args:    []string{"-http-address", "0.0.0.0"},
+			message: `server.httpAddress "0.0.0.0" is not a valid address`,
+		},
+		{
+			name:    "ipv6 address without brackets",
+			config:  "server:\n  httpsAddress: \"::1:8443\"\n",
+			message: `server.httpsAddress "::1:8443" is not a valid address, ipv6 addresses need brackets`,
+		},
+		{
+			name:    "invalid health address",
+			args:    []string{"-health-address", "localhost"},
+			message: `server.healthAddress "localhost" is not a valid address`,
+		},
+		{
+			name:    "zero timeout",
+			config:  "server:\n  readHeaderTimeoutSeconds: 0\n",
+			message: "server timeouts must be positive",
+		},
+		{
+			name:    "negative timeout",
+			args:    []string{"-write-timeout-seconds", "-1"},
+			message: "server timeouts must be positive",
+		},
+		{
+			name:    "zero request body limit",
+			args:    []string{"-max-request-body-bytes", "0"},
+			message: "server.maxRequestBodyBytes must be positive",
+		},
+		{
+			name:    "invalid log level",
+			args:    []string{"-log-level", "verbose"},
+			message: "Invalid server config",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := writeTestConfigFile(t, test.config)
+			_, err := loadServerConfig(configFile, test.args)
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("Expected an error containing %q, got %v", test.message, err)
+			}
+		})
+	}
+
+	if _, err := loadServerConfig(filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil || !strings.Contains(err.Error(), "Could not read config file") {
+		t.Errorf("Expected a missing config file to be an error, got %v", err)
+	}
+}
+
+func TestReloadServerConfig(t *testing.T) {
+	previousLogLevel := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(previousLogLevel) })
+
+	tests := []struct {
+		name   string
+		config string
+		// changes to the config in use after the reload
+		expect func(serverConfig *ServerConfig)
+	}{
+		{
+			name:   "mutation, policy and log level are reloaded",
+			config: "mutation:\n  shadow: true\npolicy:\n  allowedKeys: [topology.kubernetes.io/zone]\nlogging:\n  level: debug\n",
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Mutation.Shadow = true
+				serverConfig.Policy.AllowedKeys = []string{"topology.kubernetes.io/zone"}
+				serverConfig.Logging.Level = "debug"
+			},
+		},
+		{
+			name:   "settings that require a restart are kept",
+			config: "server:\n  httpAddress: \":9090\"\ncaches:\n  enableNamespaceDefaults: true\nevents:\n  enabled: true\nlogging:\n  format: text\nmutation:\n  shadow: true\n",
+			expect: func(serverConfig *ServerConfig) {
+				serverConfig.Mutation.Shadow = true
+			},
+		},
+		{
+			name:   "invalid config is rejected",
+			config: "mutation:\n  shadow: true\n  configErrorPolicy: Allow\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useServerConfig(t, defaultServerConfig())
+			configFile := writeTestConfigFile(t, test.config)
+
+			reloadServerConfig(configFile, nil)
+
+			expected := defaultServerConfig()
+			if test.expect != nil {
+				test.expect(expected)
+			}
+			assertJSONEqual(t, getServerConfig(), expected)
+			if level, _ := parseLogLevel(getServerConfig().Logging.Level); logLevel.Level() != level {
+				t.Errorf("Expected log level %v, got %v", level, logLevel.Level())
+			}
+		})
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(serverConfig *ServerConfig)
+		expect bool
+	}{
+		{name: "unchanged", modify: func(serverConfig *ServerConfig) {}},
+		{name: "mutation", modify: func(serverConfig *ServerConfig) { serverConfig.Mutation.ConfigErrorPolicy = configErrorPolicyIgnore }},
+		{name: "policy", modify: func(serverConfig *ServerConfig) { serverConfig.Policy.ExcludedNamespaces = nil }},
+		{name: "log level", modify: func(serverConfig *ServerConfig) { serverConfig.Logging.Level = "debug" }},
+		{name: "server", modify: func(serverConfig *ServerConfig) { serverConfig.Server.MaxRequestBodyBytes = 1 }, expect: true},
+		{name: "caches", modify: func(serverConfig *ServerConfig) { serverConfig.Caches.ConfigMapNamespaces = []string{"config"} }, expect: true},
+		{name: "events", modify: func(serverConfig *ServerConfig) { serverConfig.Events.PodEvents = true }, expect: true},
+		{name: "tracing", modify: func(serverConfig *ServerConfig) { serverConfig.Tracing.SamplingRatio = 0.5 }, expect: true},
+		{name: "certificates", modify: func(serverConfig *ServerConfig) { serverConfig.Certificates.ValidityDays = 30 }, expect: true},
+		{name: "log format", modify: func(serverConfig *ServerConfig) { serverConfig.Logging.Format = logFormatText }, expect: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldServerConfig := defaultServerConfig()
+			serverConfig := defaultServerConfig()
+			test.modify(serverConfig)
+			if requiresRestart := serverConfig.requiresRestart(oldServerConfig); requiresRestart != test.expect {
+				t.Errorf("Expected requiresRestart to be %v, got %v", test.expect, requiresRestart)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	eventComponent         = "statefulset-affinity-injector"
+	eventQueueSize         = 1000
+	eventAggregationWindow = 10 * time.Minute
+	// objects are looked up this often before an event about an object that
+	// is still being created is dropped
+	eventLookupAttempts   = 5
+	eventLookupRetryDelay = 2 * time.Second
+
+	eventReasonAffinityInjected = "AffinityInjected"
+	eventReasonInvalidConfig    = "InvalidConfig"
+	eventReasonPolicyViolation  = "PolicyViolation"
+)
+
+type EventOptions struct {
+	Enabled bool `json:"enabled"`
+	// also post an event on the pod once it has been created
+	PodEvents            bool `json:"podEvents"`
+	PodEventDelaySeconds int  `json:"podEventDelaySeconds"`
+	// every object may get up to burst events at once, and one more
+	// every refillSeconds after that
+	BurstPerObject int `json:"burstPerObject"`
+	RefillSeconds  int `json:"refillSeconds"`
+}
+
+func (o *EventOptions) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+
+	if o.BurstPerObject <= 0 || o.RefillSeconds <= 0 {
+		return fmt.Errorf("events.burstPerObject and events.refillSeconds must be positive")
+	}
+
+	if o.PodEventDelaySeconds < 0 {
+		return fmt.Errorf("events.podEventDelaySeconds can not be negative")
+	}
+
+	return nil
+}
+
+type eventBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type recordedEvent struct {
+	namespace string
+	name      string
+	count     int32
+	lastSeen  time.Time
+}
+
+// EventRecorder posts events without blocking admission requests. Events are
+// rate limited per involved object, and identical events within the
+// aggregation window increase the count of the existing event instead of
+// creating new ones. A nil recorder drops all events.
+type EventRecorder struct {
+	client   *KubeClient
+	options  EventOptions
+	instance string
+	now      func() time.Time
+
+	queue chan *corev1.Event
+
+	mutex   sync.Mutex
+	buckets map[string]*eventBucket
+	// only used by the worker
+	recent         map[string]*recordedEvent
+	lookupAttempts map[string]int
+	retryDelay     time.Duration
+}
+
+// eventRecorder is nil unless events are enabled
+var eventRecorder *EventRecorder
+
+func NewEventRecorder(client *KubeClient, options EventOptions) *EventRecorder {
+	instance, _ := os.Hostname()
+	return &EventRecorder{
+		client:   client,
+		options:  options,
+		instance: instance,
+		now:      time.Now,
+		queue:    make(chan *corev1.Event, eventQueueSize),
+		buckets:  make(map[string]*eventBucket),
+		recent:   make(map[string]*recordedEvent),
+
+		lookupAttempts: make(map[string]int),
+		retryDelay:     eventLookupRetryDelay,
+	}
+}
+
+func getObjectReferenceKey(object *corev1.ObjectReference) string {
+	return strings.Join([]string{object.Kind, object.Namespace, object.Name}, "/")
+}
+
+// allow takes a token from the bucket of the object, refilling it first
+func (r *EventRecorder) allow(object *corev1.ObjectReference) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	refillInterval := time.Duration(r.options.RefillSeconds) * time.Second
+	burst := float64(r.options.BurstPerObject)
+
+	key := getObjectReferenceKey(object)
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &eventBucket{tokens: burst, lastRefill: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(burst, bucket.tokens+float64(now.Sub(bucket.lastRefill))/float64(refillInterval))
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Eventf queues an event about object, dropping it if the object is over its
+// rate limit or the queue is full
+func (r *EventRecorder) Eventf(object *corev1.ObjectReference, eventType string, reason string, messageFormat string, args ...interface{}) {
+	if r == nil || object == nil {
+		return
+	}
+
+	if !r.allow(object) {
+		slog.Debug("Dropped rate limited event", "object", getObjectReferenceKey(object), "reason", reason)
+		return
+	}
+
+	now := metav1.NewTime(r.now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject:      *object,
+		Reason:              reason,
+		Message:             fmt.Sprintf(messageFormat, args...),
+		Type:                eventType,
+		Count:               1,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Source:              corev1.EventSource{Component: eventComponent},
+		ReportingController: eventComponent,
+		ReportingInstance:   r.instance,
+	}
+
+	select {
+	case r.queue <- event:
+	default:
+		slog.Warn("Dropped event because the event queue is full", "object", getObjectReferenceKey(object), "reason", reason)
+	}
+}
+
+// EventAfterf is Eventf after a delay, for objects that do not exist yet
+// while their admission request is handled. Events about objects without a
+// uid are only written once the object has been looked up.
+func (r *EventRecorder) EventAfterf(delay time.Duration, object *corev1.ObjectReference, eventType string, reason string, messageFormat string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		r.Eventf(object, eventType, reason, messageFormat, args...)
+	})
+}
+
+// Run writes queued events until ctx is cancelled
+func (r *EventRecorder) Run(ctx context.Context) {
+	pruneTicker := time.NewTicker(time.Minute)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-r.queue:
+			if err := r.write(ctx, event); err != nil {
+				slog.Warn("Could not write event", "object", getObjectReferenceKey(&event.InvolvedObject), "reason", event.Reason, "error", err)
+			}
+		case <-pruneTicker.C:
+			r.prune()
+		}
+	}
+}
+
+// getObjectPath returns the api path of a pod or statefulset reference
+func getObjectPath(object *corev1.ObjectReference) string {
+	prefix := "/apis/" + object.APIVersion
+	if !strings.Contains(object.APIVersion, "/") {
+		prefix = "/api/" + object.APIVersion
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%ss/%s", prefix, object.Namespace, strings.ToLower(object.Kind), object.Name)
+}
+
+// resolveUID sets the uid of the involved object of an event about an object
+// that did not exist yet during its admission request. It returns false if
+// the event has to wait for the object to be created.
+func (r *EventRecorder) resolveUID(ctx context.Context, event *corev1.Event) (bool, error) {
+	var object metav1.PartialObjectMetadata
+	err := r.client.Get(ctx, getObjectPath(&event.InvolvedObject), &object)
+	if isNotFound(err) {
+		r.lookupAttempts[event.Name]++
+		if r.lookupAttempts[event.Name] >= eventLookupAttempts {
+			// e.g. a statefulset whose creation was denied
+			delete(r.lookupAttempts, event.Name)
+			slog.Debug("Dropped event about an object that was not created", "object", getObjectReferenceKey(&event.InvolvedObject), "reason", event.Reason)
+			return false, nil
+		}
+
+		time.AfterFunc(r.retryDelay, func() {
+			select {
+			case r.queue <- event:
+			default:
+				slog.Warn("Dropped event because the event queue is full", "object", getObjectReferenceKey(&event.InvolvedObject), "reason", event.Reason)
+			}
+		})
+		return false, nil
+	}
+	delete(r.lookupAttempts, event.Name)
+	if err != nil {
+		return false, fmt.Errorf("Could not look up %s: %v", getObjectReferenceKey(&event.InvolvedObject), err)
+	}
+
+	// a different object with the same name would get the event otherwise
+	if object.UID == "" {
+		return false, fmt.Errorf("Could not look up %s: no uid", getObjectReferenceKey(&event.InvolvedObject))
+	}
+	event.InvolvedObject.UID = object.UID
+	return true, nil
+}
+
+func (r *EventRecorder) write(ctx context.Context, event *corev1.Event) error {
+	if event.InvolvedObject.UID == "" {
+		resolved, err := r.resolveUID(ctx, event)
+		if !resolved {
+			return err
+		}
+	}
+
+	key := strings.Join([]string{getObjectReferenceKey(&event.InvolvedObject), event.Type, event.Reason, event.Message}, "/")
+	eventsPath := fmt.Sprintf("/api/v1/namespaces/%s/events", event.Namespace)
+
+	recent, ok := r.recent[key]
+	if ok && event.LastTimestamp.Sub(recent.lastSeen) < eventAggregationWindow {
+		recent.count++
+		recent.lastSeen = event.LastTimestamp.Time
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"count":         recent.count,
+			"lastTimestamp": event.LastTimestamp,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = r.client.Patch(ctx, eventsPath+"/"+recent.name, "application/merge-patch+json", patch)
+		if !isNotFound(err) {
+			return err
+		}
+		// the event expired on the server, so a new one is created
+	}
+
+	if err := r.client.Create(ctx, eventsPath, event); err != nil {
+		return err
+	}
+
+	r.recent[key] = &recordedEvent{
+		namespace: event.Namespace,
+		name:      event.Name,
+		count:     1,
+		lastSeen:  event.LastTimestamp.Time,
+	}
+	return nil
+}
+
+func (r *EventRecorder) prune() {
+	now := r.now()
+	for key, recent := range r.recent {
+		if now.Sub(recent.lastSeen) >= eventAggregationWindow {
+			delete(r.recent, key)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// a bucket that refilled completely is the same as no bucket
+	fullAfter := time.Duration(r.options.BurstPerObject*r.options.RefillSeconds) * time.Second
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.lastRefill) >= fullAfter {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func startEventRecorder(ctx context.Context, client *KubeClient, eventOptions *EventOptions) {
+	if !eventOptions.Enabled {
+		return
+	}
+
+	eventRecorder = NewEventRecorder(client, *eventOptions)
+	go eventRecorder.Run(ctx)
+}
+
+// getStatefulSetOwnerReference returns a reference to the statefulset that
+// owns the pod, or nil if it is not owned by one
+func getStatefulSetOwnerReference(pod *corev1.Pod) *corev1.ObjectReference {
+	for _, ownerReference := range pod.OwnerReferences {
+		if ownerReference.Kind == "StatefulSet" {
+			return &corev1.ObjectReference{
+				APIVersion: ownerReference.APIVersion,
+				Kind:       ownerReference.Kind,
+				Namespace:  pod.Namespace,
+				Name:       ownerReference.Name,
+				UID:        ownerReference.UID,
+			}
+		}
+	}
+
+	return nil
+}
+
+func getObjectReference(object K8sObject, apiVersion string, kind string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  object.GetNamespace(),
+		Name:       object.GetName(),
+		UID:        object.GetUID(),
+	}
+}
+
+func formatPodPlacement(podPlacement map[string]string) string {
+	requirements := make([]string, 0, len(podPlacement))
+	for _, key := range getSortedKeys(podPlacement) {
+		requirements = append(requirements, key+"="+podPlacement[key])
+	}
+	return strings.Join(requirements, ", ")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestEventRecorder(client *KubeClient, now *time.Time) *EventRecorder {
+	recorder := NewEventRecorder(client, EventOptions{Enabled: true, BurstPerObject: 2, RefillSeconds: 60})
+	recorder.instance = "injector-0"
+	recorder.now = func() time.Time { return *now }
+	recorder.retryDelay = time.Millisecond
+	return recorder
+}
+
+// writeQueued writes the next queued event, waiting for events that are
+// queued again after a lookup
+func writeQueued(t *testing.T, recorder *EventRecorder) {
+	t.Helper()
+	select {
+	case event := <-recorder.queue:
+		if err := recorder.write(context.Background(), event); err != nil {
+			t.Fatalf("Could not write event: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a queued event")
+	}
+}
+
+func TestEventRecorderEventBody(t *testing.T) {
+	client, requests := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	recorder := newTestEventRecorder(client, &now)
+
+	statefulSet := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Namespace: "db", Name: "web", UID: "1234"}
+	recorder.Eventf(statefulSet, corev1.EventTypeNormal, eventReasonAffinityInjected, "Ordinal %d pinned to %s", 3, "zone=c")
+	writeQueued(t, recorder)
+
+	if len(*requests) != 1 || (*requests)[0].Method != "POST" || (*requests)[0].Path != "/api/v1/namespaces/db/events" {
+		t.Fatalf("Expected one event to be created, got %v", *requests)
+	}
+
+	var event corev1.Event
+	if err := json.Unmarshal([]byte((*requests)[0].Body), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.InvolvedObject != *statefulSet {
+		t.Errorf("Unexpected involved object %+v", event.InvolvedObject)
+	}
+	if event.Namespace != "db" || event.Name != fmt.Sprintf("web.%x", now.UnixNano()) {
+		t.Errorf("Unexpected event %s/%s", event.Namespace, event.Name)
+	}
+	if event.Type != corev1.EventTypeNormal || event.Reason != eventReasonAffinityInjected || event.Message != "Ordinal 3 pinned to zone=c" || event.Count != 1 {
+		t.Errorf("Unexpected event %s %s %q count %d", event.Type, event.Reason, event.Message, event.Count)
+	}
+	if !event.FirstTimestamp.Time.Equal(now) || !event.LastTimestamp.Time.Equal(now) {
+		t.Errorf("Unexpected timestamps %v, %v", event.FirstTimestamp, event.LastTimestamp)
+	}
+	if event.Source.Component != eventComponent || event.ReportingController != eventComponent || event.ReportingInstance != "injector-0" {
+		t.Errorf("Unexpected source %+v, %s, %s", event.Source, event.ReportingController, event.ReportingInstance)
+	}
+}
+
+func TestEventRecorderRateLimit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	recorder := newTestEventRecorder(nil, &now)
+
+	web := &corev1.ObjectReference{Kind: "StatefulSet", Namespace: "db", Name: "web", UID: "1"}
+	other := &corev1.ObjectReference{Kind: "StatefulSet", Namespace: "db", Name: "other", UID: "2"}
+
+	steps := []struct {
+		after  time.Duration
+		object *corev1.ObjectReference
+		queued int
+	}{
+		{object: web, queued: 1},
+		{object: web, queued: 2},
+		// the burst is used up
+		{object: web, queued: 2},
+		// other objects have their own bucket
+		{object: other, queued: 3},
+		{after: 30 * time.Second, object: web, queued: 3},
+		{after: 30 * time.Second, object: web, queued: 4},
+		{object: web, queued: 4},
+	}
+	for index, step := range steps {
+		now = now.Add(step.after)
+		recorder.Eventf(step.object, corev1.EventTypeNormal, eventReasonAffinityInjected, "Event %d", index)
+		if len(recorder.queue) != step.queued {
+			t.Errorf("Step %d: expected %d queued events, got %d", index, step.queued, len(recorder.queue))
+		}
+	}
+}
+
+func TestEventRecorderAggregation(t *testing.T) {
+	expired := false
+	client, requests := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" && expired {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	recorder := newTestEventRecorder(client, &now)
+	recorder.options.BurstPerObject = 10
+
+	statefulSet := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Namespace: "db", Name: "web", UID: "1234"}
+	record := func(message string) {
+		recorder.Eventf(statefulSet, corev1.EventTypeWarning, eventReasonInvalidConfig, "%s", message)
+		writeQueued(t, recorder)
+	}
+
+	record("invalid")
+	now = now.Add(time.Minute)
+	record("invalid")
+	record("other")
+	now = now.Add(eventAggregationWindow)
+	record("invalid")
+	now = now.Add(time.Minute)
+	expired = true
+	record("invalid")
+
+	eventPath := func(created time.Time) string {
+		return fmt.Sprintf("/api/v1/namespaces/db/events/web.%x", created.UnixNano())
+	}
+	expected := []recordedRequest{
+		{Method: "POST", Path: "/api/v1/namespaces/db/events"},
+		{Method: "PATCH", Path: eventPath(start), Body: `{"count":2,"lastTimestamp":"2024-05-01T12:01:00Z"}`},
+		// a different message is a different event
+		{Method: "POST", Path: "/api/v1/namespaces/db/events"},
+		// outside of the aggregation window
+		{Method: "POST", Path: "/api/v1/namespaces/db/events"},
+		// the event expired on the server
+		{Method: "PATCH", Path: eventPath(start.Add(time.Minute + eventAggregationWindow))},
+		{Method: "POST", Path: "/api/v1/namespaces/db/events"},
+	}
+	if len(*requests) != len(expected) {
+		t.Fatalf("Expected %d requests, got %v", len(expected), *requests)
+	}
+	for index, request := range *requests {
+		if request.Method != expected[index].Method || request.Path != expected[index].Path {
+			t.Errorf("Request %d: expected %s %s, got %s %s", index, expected[index].Method, expected[index].Path, request.Method, request.Path)
+		}
+		if expected[index].Body != "" && request.Body != expected[index].Body {
+			t.Errorf("Request %d: expected body %s, got %s", index, expected[index].Body, request.Body)
+		}
+	}
+
+	var event corev1.Event
+	json.Unmarshal([]byte((*requests)[5].Body), &event)
+	if event.Count != 1 || event.Name != fmt.Sprintf("web.%x", now.UnixNano()) {
+		t.Errorf("Expected a new event after the old one expired, got %s with count %d", event.Name, event.Count)
+	}
+}
+
+func TestEventRecorderLooksUpUID(t *testing.T) {
+	lookups := 0
+	client, requests := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/db/pods/web-0":
+			// the pod is created after the first lookup
+			lookups++
+			if lookups == 1 {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"metadata":{"name":"web-0","uid":"5678"}}`))
+		case "/apis/apps/v1/namespaces/db/statefulsets/denied":
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	recorder := newTestEventRecorder(client, &now)
+
+	recorder.Eventf(&corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "db", Name: "web-0"}, corev1.EventTypeNormal, eventReasonAffinityInjected, "Pinned")
+	writeQueued(t, recorder)
+	writeQueued(t, recorder)
+
+	if len(*requests) != 3 || (*requests)[2].Method != "POST" {
+		t.Fatalf("Expected two lookups and the event, got %v", *requests)
+	}
+	var event corev1.Event
+	json.Unmarshal([]byte((*requests)[2].Body), &event)
+	if event.InvolvedObject.UID != types.UID("5678") {
+		t.Errorf("Expected the event to reference the uid of the pod, got %q", event.InvolvedObject.UID)
+	}
+
+	// a statefulset that is never created gets no event
+	*requests = nil
+	recorder.Eventf(&corev1.ObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Namespace: "db", Name: "denied"}, corev1.EventTypeWarning, eventReasonPolicyViolation, "Denied")
+	for attempt := 0; attempt < eventLookupAttempts; attempt++ {
+		writeQueued(t, recorder)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if len(recorder.queue) != 0 {
+		t.Errorf("Expected the event to be dropped after %d lookups", eventLookupAttempts)
+	}
+	for _, request := range *requests {
+		if request.Method != "GET" {
+			t.Errorf("Expected only lookups for a statefulset that does not exist, got %s %s", request.Method, request.Path)
+		}
+	}
+	if len(*requests) != eventLookupAttempts {
+		t.Errorf("Expected %d lookups, got %d", eventLookupAttempts, len(*requests))
+	}
+}
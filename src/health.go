@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthChecks is a set of named checks backing /livez or /readyz. Checks are
+// added during startup by the features that need them.
+type HealthChecks struct {
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]func() error
+}
+
+var (
+	livenessChecks  = &HealthChecks{checks: map[string]func() error{}}
+	readinessChecks = &HealthChecks{checks: map[string]func() error{}}
+
+	// set on SIGTERM so the pod is taken out of the service before the
+	// server shuts down
+	shuttingDown atomic.Bool
+
+	// set while the admission server accepts connections, the health
+	// server may run on its own listener and outlive it
+	serving atomic.Bool
+)
+
+func (h *HealthChecks) Add(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// run returns the result of every check by name and whether all passed
+func (h *HealthChecks) run() (map[string]string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	results := make(map[string]string, len(h.names))
+	healthy := true
+	for _, name := range h.names {
+		if err := h.checks[name](); err != nil {
+			results[name] = err.Error()
+			healthy = false
+		} else {
+			results[name] = "ok"
+		}
+	}
+	return results, healthy
+}
+
+func handleHealthChecks(h *HealthChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, healthy := h.run()
+
+		status := "ok"
+		statusCode := http.StatusOK
+		if !healthy {
+			status = "failed"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		respBytes, _ := json.Marshal(map[string]interface{}{"status": status, "checks": results})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(respBytes)
+	}
+}
+
+// checkServing fails once the admission server stopped serving, so the pod
+// is restarted even if the health server keeps answering
+func checkServing() error {
+	if !serving.Load() {
+		return fmt.Errorf("admission server is not serving")
+	}
+	return nil
+}
+
+func checkShutdown() error {
+	if shuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// checkConfig fails if no valid config is in use. A config file that fails
+// to reload keeps the previous config in use, so it does not make every
+// replica unready at once.
+func checkConfig() error {
+	serverConfig := getServerConfig()
+	if serverConfig == nil {
+		return fmt.Errorf("no server config loaded")
+	}
+	if err := serverConfig.validate(); err != nil {
+		return fmt.Errorf("Invalid server config: %v", err)
+	}
+	return nil
+}
+
+func checkCaches() error {
+	if namespaceInformer != nil && !namespaceInformer.HasSynced() {
+		return fmt.Errorf("namespace cache has not synced")
+	}
+	for configMapNamespace, configMapInformer := range configMapInformers {
+		if !configMapInformer.HasSynced() {
+			return fmt.Errorf("configmap cache of namespace %q has not synced", configMapNamespace)
+		}
+	}
+	return nil
+}
+
+// checkCertificate fails until a certificate is loaded and once it expired
+func (c *CertificateReloader) checkCertificate() error {
+	if c.certificate.Load() == nil {
+		return fmt.Errorf("no certificate loaded from %s", c.source)
+	}
+	if expiry := c.getExpiry(); time.Now().After(expiry) {
+		return fmt.Errorf("certificate from %s expired at %s", c.source, expiry.Format(time.RFC3339))
+	}
+	return nil
+}
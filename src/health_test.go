@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getHealth runs the checks behind a probe endpoint and returns the status
+// code and the result of every check
+func getHealth(t *testing.T, healthChecks *HealthChecks) (int, map[string]string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handleHealthChecks(healthChecks)(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	var response struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Could not decode the health response %s: %v", recorder.Body.String(), err)
+	}
+	if (response.Status == "ok") != (recorder.Code == http.StatusOK) {
+		t.Errorf("Expected the status %q to match the status code %d", response.Status, recorder.Code)
+	}
+	return recorder.Code, response.Checks
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	healthChecks := &HealthChecks{checks: map[string]func() error{}}
+	healthChecks.Add("config", checkConfig)
+	healthChecks.Add("shutdown", checkShutdown)
+
+	if statusCode, checks := getHealth(t, healthChecks); statusCode != http.StatusOK {
+		t.Fatalf("Expected /readyz to pass before shutdown, got %d %v", statusCode, checks)
+	}
+
+	// runServer sets it on SIGTERM, before the drain delay
+	shuttingDown.Store(true)
+	statusCode, checks := getHealth(t, healthChecks)
+	if statusCode != http.StatusServiceUnavailable || checks["shutdown"] != "shutting down" || checks["config"] != "ok" {
+		t.Errorf("Expected only the shutdown check to fail while draining, got %d %v", statusCode, checks)
+	}
+}
+
+func TestLivezFailsWhenNotServing(t *testing.T) {
+	t.Cleanup(func() { serving.Store(false) })
+
+	healthChecks := &HealthChecks{checks: map[string]func() error{}}
+	healthChecks.Add("server", checkServing)
+
+	if statusCode, checks := getHealth(t, healthChecks); statusCode != http.StatusServiceUnavailable || checks["server"] != "admission server is not serving" {
+		t.Errorf("Expected /livez to fail while the admission server is not serving, got %d %v", statusCode, checks)
+	}
+
+	serving.Store(true)
+	if statusCode, checks := getHealth(t, healthChecks); statusCode != http.StatusOK {
+		t.Errorf("Expected /livez to pass while the admission server is serving, got %d %v", statusCode, checks)
+	}
+}
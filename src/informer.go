@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	informerMinBackoff = time.Second
+	informerMaxBackoff = 30 * time.Second
+)
+
+// errWatchExpired is returned from a watch when the resource version we
+// watch from is too old and the cache has to be rebuilt from a fresh list
+var errWatchExpired = fmt.Errorf("Watch resource version expired")
+
+// Informer keeps an in-memory copy of a collection of kubernetes objects
+// up to date using list and watch. T is the object type, e.g. corev1.Namespace.
+type Informer[T any, PT interface {
+	*T
+	metav1.Object
+}] struct {
+	client        *KubeClient
+	path          string
+	labelSelector string
+
+	// bounds of the backoff between failed attempts
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mutex  sync.RWMutex
+	items  map[string]PT
+	synced chan struct{}
+	once   sync.Once
+}
+
+func NewInformer[T any, PT interface {
+	*T
+	metav1.Object
+}](client *KubeClient, path string, labelSelector string) *Informer[T, PT] {
+	return &Informer[T, PT]{
+		client:        client,
+		path:          path,
+		labelSelector: labelSelector,
+		minBackoff:    informerMinBackoff,
+		maxBackoff:    informerMaxBackoff,
+		items:         make(map[string]PT),
+		synced:        make(chan struct{}),
+	}
+}
+
+func informerKey(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// Get returns the cached object. Cluster scoped objects have an empty namespace.
+func (i *Informer[T, PT]) Get(namespace string, name string) (PT, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	item, ok := i.items[informerKey(namespace, name)]
+	return item, ok
+}
+
+func (i *Informer[T, PT]) HasSynced() bool {
+	select {
+	case <-i.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i *Informer[T, PT]) WaitForSync(ctx context.Context) error {
+	select {
+	case <-i.synced:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for %s cache to sync: %v", i.path, ctx.Err())
+	}
+}
+
+// Run keeps the cache in sync until ctx is cancelled. Failed lists and
+// watches that end before delivering any event are retried with exponential
+// backoff and jitter, so an API server that keeps failing or closing watches
+// right away is not hammered. The backoff is only reset by a healthy watch,
+// since a successful list followed by a failing watch is not progress.
+func (i *Informer[T, PT]) Run(ctx context.Context) {
+	backoff := i.minBackoff
+	resourceVersion := ""
+	for ctx.Err() == nil {
+		var err error
+		wait := false
+		if resourceVersion == "" {
+			resourceVersion, err = i.list(ctx)
+			if err == nil && resourceVersion == "" {
+				err = fmt.Errorf("List of %s returned no resource version", i.path)
+			}
+		} else {
+			started := time.Now()
+			var events int
+			resourceVersion, events, err = i.watch(ctx, resourceVersion)
+			// a watch that delivered events or stayed open for a while was healthy
+			if events > 0 || time.Since(started) >= i.maxBackoff {
+				backoff = i.minBackoff
+			} else {
+				wait = true
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == errWatchExpired {
+			slog.Debug("Watch expired, relisting", "path", i.path)
+			resourceVersion = ""
+		} else if err != nil {
+			resourceVersion = ""
+			wait = true
+			slog.Warn("Cache failed, retrying", "path", i.path, "backoff", backoff.String(), "error", err)
+		}
+
+		if !wait {
+			continue
+		}
+
+		// jitter keeps replicas that failed together from retrying together
+		delay := backoff + rand.N(backoff/2+1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, i.maxBackoff)
+	}
+}
+
+func (i *Informer[T, PT]) query(extra url.Values) string {
+	query := url.Values{}
+	if i.labelSelector != "" {
+		query.Set("labelSelector", i.labelSelector)
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+	return i.path + "?" + query.Encode()
+}
+
+func (i *Informer[T, PT]) list(ctx context.Context) (string, error) {
+	var list struct {
+		Metadata metav1.ListMeta `json:"metadata"`
+		Items    []T             `json:"items"`
+	}
+
+	if err := i.client.Get(ctx, i.query(nil), &list); err != nil {
+		return "", err
+	}
+
+	items := make(map[string]PT, len(list.Items))
+	for index := range list.Items {
+		item := PT(&list.Items[index])
+		items[informerKey(item.GetNamespace(), item.GetName())] = item
+	}
+
+	i.mutex.Lock()
+	i.items = items
+	i.mutex.Unlock()
+
+	i.once.Do(func() { close(i.synced) })
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies events to the cache and returns the last seen resource
+// version, so that a watch closed by the server can be resumed without a
+// relist, along with the number of events it received
+func (i *Informer[T, PT]) watch(ctx context.Context, resourceVersion string) (string, int, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+
+	events := 0
+	err := i.client.Watch(ctx, i.query(query), func(eventType string, object json.RawMessage) error {
+		if eventType == "ERROR" {
+			var status metav1.Status
+			if err := json.Unmarshal(object, &status); err == nil && status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return fmt.Errorf("Watch on %s returned an error: %s", i.path, string(object))
+		}
+
+		// errors do not count, a watch that expires right away is no progress
+		events++
+
+		item := PT(new(T))
+		if err := json.Unmarshal(object, item); err != nil {
+			return fmt.Errorf("Could not decode watched object from %s: %v", i.path, err)
+		}
+
+		resourceVersion = item.GetResourceVersion()
+		if eventType == "BOOKMARK" {
+			return nil
+		}
+
+		key := informerKey(item.GetNamespace(), item.GetName())
+
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+
+		switch eventType {
+		case "ADDED", "MODIFIED":
+			i.items[key] = item
+		case "DELETED":
+			delete(i.items, key)
+		}
+
+		return nil
+	})
+
+	return resourceVersion, events, err
+}
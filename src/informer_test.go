@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeNamespaceServer serves namespace lists and watches from scripted
+// responses, the last one is repeated once the script runs out
+type fakeNamespaceServer struct {
+	mutex   sync.Mutex
+	lists   []func(w http.ResponseWriter)
+	watches []func(w http.ResponseWriter, r *http.Request)
+
+	listCount        int
+	watchCount       int
+	watchFromVersion []string
+}
+
+func (s *fakeNamespaceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/namespaces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mutex.Lock()
+	if r.URL.Query().Get("watch") == "true" {
+		handler := s.watches[min(s.watchCount, len(s.watches)-1)]
+		s.watchCount++
+		s.watchFromVersion = append(s.watchFromVersion, r.URL.Query().Get("resourceVersion"))
+		s.mutex.Unlock()
+		handler(w, r)
+		return
+	}
+
+	handler := s.lists[min(s.listCount, len(s.lists)-1)]
+	s.listCount++
+	s.mutex.Unlock()
+	handler(w)
+}
+
+func (s *fakeNamespaceServer) counts() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listCount, s.watchCount
+}
+
+func namespaceList(resourceVersion string, names ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		list := corev1.NamespaceList{ListMeta: metav1.ListMeta{ResourceVersion: resourceVersion}}
+		for _, name := range names {
+			list.Items = append(list.Items, corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion}})
+		}
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+func writeWatchEvent(w http.ResponseWriter, eventType string, object interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"type": eventType, "object": object})
+	w.(http.Flusher).Flush()
+}
+
+// blockingWatch keeps the watch open until the client goes away
+func blockingWatch(w http.ResponseWriter, r *http.Request) {
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+func startTestInformer(t *testing.T, server *fakeNamespaceServer, minBackoff time.Duration) (*Informer[corev1.Namespace, *corev1.Namespace], context.CancelFunc) {
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client := &KubeClient{BaseURL: httpServer.URL, HTTPClient: httpServer.Client()}
+	informer := NewInformer[corev1.Namespace](client, "/api/v1/namespaces", "")
+	informer.minBackoff = minBackoff
+	informer.maxBackoff = 8 * minBackoff
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		informer.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return informer, cancel
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInformerRelistsAfterWatchExpired(t *testing.T) {
+	server := &fakeNamespaceServer{
+		lists: []func(w http.ResponseWriter){
+			namespaceList("1", "a"),
+			namespaceList("5", "a", "c"),
+		},
+		watches: []func(w http.ResponseWriter, r *http.Request){
+			func(w http.ResponseWriter, r *http.Request) {
+				writeWatchEvent(w, "ADDED", corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b", ResourceVersion: "2"}})
+				writeWatchEvent(w, "ERROR", metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonExpired})
+			},
+			blockingWatch,
+		},
+	}
+	informer, _ := startTestInformer(t, server, time.Hour)
+
+	waitFor(t, "the second watch", func() bool {
+		_, watches := server.counts()
+		return watches == 2
+	})
+
+	lists, _ := server.counts()
+	if lists != 2 {
+		t.Errorf("Expected 2 lists, got %d", lists)
+	}
+	if !informer.HasSynced() {
+		t.Errorf("Informer has not synced")
+	}
+
+	server.mutex.Lock()
+	watchFromVersion := server.watchFromVersion
+	server.mutex.Unlock()
+	if fmt.Sprint(watchFromVersion) != "[1 5]" {
+		t.Errorf("Expected watches from resource versions [1 5], got %v", watchFromVersion)
+	}
+
+	for name, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := informer.Get("", name); ok != expected {
+			t.Errorf("Expected namespace %s cached to be %v after the relist", name, expected)
+		}
+	}
+}
+
+func TestInformerAppliesWatchEvents(t *testing.T) {
+	server := &fakeNamespaceServer{
+		lists: []func(w http.ResponseWriter){namespaceList("1", "a", "b")},
+		watches: []func(w http.ResponseWriter, r *http.Request){
+			func(w http.ResponseWriter, r *http.Request) {
+				writeWatchEvent(w, "DELETED", corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a", ResourceVersion: "2"}})
+				writeWatchEvent(w, "MODIFIED", corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b", ResourceVersion: "3", Annotations: map[string]string{"x": "y"}}})
+				writeWatchEvent(w, "BOOKMARK", corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "4"}})
+			},
+			blockingWatch,
+		},
+	}
+	informer, _ := startTestInformer(t, server, time.Hour)
+
+	waitFor(t, "the resumed watch", func() bool {
+		_, watches := server.counts()
+		return watches == 2
+	})
+
+	if _, ok := informer.Get("", "a"); ok {
+		t.Errorf("Deleted namespace a is still cached")
+	}
+	if namespace, ok := informer.Get("", "b"); !ok || namespace.Annotations["x"] != "y" {
+		t.Errorf("Modified namespace b was not updated: %v", namespace)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.listCount != 1 || server.watchFromVersion[1] != "4" {
+		t.Errorf("Expected the watch to resume from the bookmark without a relist, got %d lists and watches from %v", server.listCount, server.watchFromVersion)
+	}
+}
+
+func TestInformerBacksOff(t *testing.T) {
+	tests := []struct {
+		name    string
+		lists   []func(w http.ResponseWriter)
+		watches []func(w http.ResponseWriter, r *http.Request)
+	}{
+		{
+			name:  "list without resource version",
+			lists: []func(w http.ResponseWriter){namespaceList("", "a")},
+		},
+		{
+			name: "failing list",
+			lists: []func(w http.ResponseWriter){func(w http.ResponseWriter) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			}},
+		},
+		{
+			name:  "watch closed right away",
+			lists: []func(w http.ResponseWriter){namespaceList("1", "a")},
+			watches: []func(w http.ResponseWriter, r *http.Request){func(w http.ResponseWriter, r *http.Request) {
+				w.(http.Flusher).Flush()
+			}},
+		},
+		{
+			name:  "watch expired right away",
+			lists: []func(w http.ResponseWriter){namespaceList("1", "a")},
+			watches: []func(w http.ResponseWriter, r *http.Request){func(w http.ResponseWriter, r *http.Request) {
+				writeWatchEvent(w, "ERROR", metav1.Status{Code: http.StatusGone})
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &fakeNamespaceServer{lists: test.lists, watches: test.watches}
+			_, cancel := startTestInformer(t, server, 20*time.Millisecond)
+
+			// without backoff this would be thousands of requests, with it the
+			// waits of 20, 40, 80 and 160ms plus jitter leave room for a few
+			time.Sleep(300 * time.Millisecond)
+			cancel()
+
+			lists, watches := server.counts()
+			if lists+watches > 12 {
+				t.Errorf("Expected the informer to back off, got %d lists and %d watches in 300ms", lists, watches)
+			}
+			if lists+watches < 3 {
+				t.Errorf("Expected the informer to retry, got %d lists and %d watches", lists, watches)
+			}
+		})
+	}
+}
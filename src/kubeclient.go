@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	inClusterTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	tokenRefreshPeriod     = time.Minute
+)
+
+// KubeClient is a minimal client for the kubernetes REST API. It only
+// supports what the webhook needs: getting, creating, updating and patching
+// objects and watching collections. BaseURL can point to any server speaking the
+// API, so it can also be used against a fake API server.
+type KubeClient struct {
+	BaseURL    string
+	TokenFile  string
+	HTTPClient *http.Client
+
+	tokenMutex    sync.Mutex
+	token         string
+	tokenReadTime time.Time
+}
+
+// KubeAPIError is returned when the API server responds with a non 2xx status
+type KubeAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *KubeAPIError) Error() string {
+	return fmt.Sprintf("Kubernetes API server returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*KubeAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// isConflict reports whether an update lost against a concurrent write, or
+// a create against an object that already exists
+func isConflict(err error) bool {
+	apiErr, ok := err.(*KubeAPIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// getInClusterNamespace returns the namespace the webhook runs in
+func getInClusterNamespace() (string, error) {
+	namespaceBytes, err := os.ReadFile(inClusterNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not read in-cluster namespace file: %v", err)
+	}
+	return strings.TrimSpace(string(namespaceBytes)), nil
+}
+
+func NewInClusterKubeClient() (*KubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("Could not create in-cluster kubernetes client: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	caBytes, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read in-cluster CA file: %v", err)
+	}
+
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("Could not parse any certificate from %s", inClusterCAFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: caPool}
+
+	return &KubeClient{
+		BaseURL:    "https://" + net.JoinHostPort(host, port),
+		TokenFile:  inClusterTokenFile,
+		HTTPClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// service account tokens are rotated by the kubelet, so the token file is
+// re-read periodically instead of once at startup
+func (c *KubeClient) bearerToken() (string, error) {
+	if c.TokenFile == "" {
+		return "", nil
+	}
+
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.token != "" && time.Since(c.tokenReadTime) < tokenRefreshPeriod {
+		return c.token, nil
+	}
+
+	tokenBytes, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not read service account token: %v", err)
+	}
+
+	c.token = strings.TrimSpace(string(tokenBytes))
+	c.tokenReadTime = time.Now()
+	return c.token, nil
+}
+
+func (c *KubeClient) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request for %s: %v", path, err)
+	}
+
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	token, err := c.bearerToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Request to %s failed: %v", path, err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, &KubeAPIError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return response, nil
+}
+
+// Get fetches path and decodes the json response into out
+func (c *KubeClient) Get(ctx context.Context, path string, out interface{}) error {
+	response, err := c.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("Could not decode response from %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Create posts object to the collection at path
+func (c *KubeClient) Create(ctx context.Context, path string, object interface{}) error {
+	objectBytes, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("Could not marshal object for %s: %v", path, err)
+	}
+
+	response, err := c.do(ctx, http.MethodPost, path, "application/json", bytes.NewReader(objectBytes))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Update replaces the object at path. The update fails with a conflict if
+// the resource version of object is not the latest one.
+func (c *KubeClient) Update(ctx context.Context, path string, object interface{}) error {
+	objectBytes, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("Could not marshal object for %s: %v", path, err)
+	}
+
+	response, err := c.do(ctx, http.MethodPut, path, "application/json", bytes.NewReader(objectBytes))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Patch applies a patch of the given content type, e.g.
+// application/merge-patch+json, to the object at path
+func (c *KubeClient) Patch(ctx context.Context, path string, patchType string, patch []byte) error {
+	response, err := c.do(ctx, http.MethodPatch, path, patchType, bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// Watch opens a watch on path and calls handleEvent for every event until
+// the stream ends, the context is cancelled or handleEvent returns an error
+func (c *KubeClient) Watch(ctx context.Context, path string, handleEvent func(eventType string, object json.RawMessage) error) error {
+	response, err := c.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Could not decode watch event from %s: %v", path, err)
+		}
+
+		if err := handleEvent(event.Type, event.Object); err != nil {
+			return err
+		}
+	}
+}
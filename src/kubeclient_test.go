@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type recordedRequest struct {
+	Method        string
+	Path          string
+	ContentType   string
+	Authorization string
+	Body          string
+}
+
+func startRecordingServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*KubeClient, *[]recordedRequest) {
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, recordedRequest{
+			Method:        r.Method,
+			Path:          r.URL.RequestURI(),
+			ContentType:   r.Header.Get("Content-Type"),
+			Authorization: r.Header.Get("Authorization"),
+			Body:          string(body),
+		})
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return &KubeClient{BaseURL: server.URL, HTTPClient: server.Client()}, &requests
+}
+
+func TestKubeClientRequests(t *testing.T) {
+	client, requests := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"metadata":{"name":"a"}}`))
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("secret\n"), 0600)
+	client.TokenFile = tokenFile
+
+	ctx := context.Background()
+	var object struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := client.Get(ctx, "/api/v1/namespaces/a", &object); err != nil || object.Metadata.Name != "a" {
+		t.Fatalf("Get returned %v, %v", object, err)
+	}
+	if err := client.Create(ctx, "/api/v1/namespaces/a/events", map[string]string{"reason": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Update(ctx, "/api/v1/namespaces/a", map[string]string{"kind": "Namespace"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Patch(ctx, "/api/v1/namespaces/a/events/b", "application/merge-patch+json", []byte(`{"count":2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []recordedRequest{
+		{Method: "GET", Path: "/api/v1/namespaces/a", Authorization: "Bearer secret"},
+		{Method: "POST", Path: "/api/v1/namespaces/a/events", ContentType: "application/json", Authorization: "Bearer secret", Body: `{"reason":"x"}`},
+		{Method: "PUT", Path: "/api/v1/namespaces/a", ContentType: "application/json", Authorization: "Bearer secret", Body: `{"kind":"Namespace"}`},
+		{Method: "PATCH", Path: "/api/v1/namespaces/a/events/b", ContentType: "application/merge-patch+json", Authorization: "Bearer secret", Body: `{"count":2}`},
+	}
+	if len(*requests) != len(expected) {
+		t.Fatalf("Expected %d requests, got %v", len(expected), *requests)
+	}
+	for index, request := range *requests {
+		if request != expected[index] {
+			t.Errorf("Request %d: expected %+v, got %+v", index, expected[index], request)
+		}
+	}
+}
+
+func TestKubeClientErrors(t *testing.T) {
+	tests := []struct {
+		status     int
+		notFound   bool
+		isConflict bool
+	}{
+		{status: http.StatusNotFound, notFound: true},
+		{status: http.StatusConflict, isConflict: true},
+		{status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		client, _ := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "denied", test.status)
+		})
+
+		err := client.Get(context.Background(), "/api/v1/namespaces/a", &struct{}{})
+		var apiErr *KubeAPIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != test.status || apiErr.Message != "denied" {
+			t.Errorf("Expected a KubeAPIError with status %d, got %v", test.status, err)
+		}
+		if isNotFound(err) != test.notFound || isConflict(err) != test.isConflict {
+			t.Errorf("Status %d: isNotFound %v, isConflict %v", test.status, isNotFound(err), isConflict(err))
+		}
+	}
+}
+
+func TestKubeClientWatch(t *testing.T) {
+	client, _ := startRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]interface{}{"type": "ADDED", "object": map[string]string{"name": "a"}})
+		encoder.Encode(map[string]interface{}{"type": "DELETED", "object": map[string]string{"name": "b"}})
+		encoder.Encode(map[string]interface{}{"type": "ADDED", "object": map[string]string{"name": "c"}})
+	})
+
+	var events []string
+	stop := errors.New("stop")
+	err := client.Watch(context.Background(), "/api/v1/namespaces?watch=true", func(eventType string, object json.RawMessage) error {
+		events = append(events, eventType+" "+string(object))
+		if len(events) == 2 {
+			return stop
+		}
+		return nil
+	})
+
+	if err != stop {
+		t.Errorf("Expected the error of the event handler, got %v", err)
+	}
+	if len(events) != 2 || events[0] != `ADDED {"name":"a"}` || events[1] != `DELETED {"name":"b"}` {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	events = nil
+	if err := client.Watch(context.Background(), "/api/v1/namespaces?watch=true", func(eventType string, object json.RawMessage) error {
+		events = append(events, eventType)
+		return nil
+	}); err != nil || len(events) != 3 {
+		t.Errorf("Expected the watch to end cleanly after 3 events, got %v, %v", events, err)
+	}
+}
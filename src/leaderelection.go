@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	// a leader that could not renew the lease for this long steps down, well
+	// before another replica may take the lease over
+	leaseRenewDeadline = 10 * time.Second
+	leaseRenewPeriod   = 5 * time.Second
+)
+
+// LeaderElector elects one replica as leader using a Lease. A lease is
+// treated as expired when it has not changed for the lease duration on our
+// own clock, so clock skew between replicas does not matter.
+type LeaderElector struct {
+	client    *KubeClient
+	namespace string
+	name      string
+	identity  string
+
+	isLeader atomic.Bool
+	// unix nanoseconds after which the leadership ends unless it is renewed
+	leaderUntil atomic.Int64
+
+	// only used by Run
+	observedRecord string
+	observedTime   time.Time
+}
+
+func NewLeaderElector(client *KubeClient, namespace string, name string) *LeaderElector {
+	identity, _ := os.Hostname()
+	return &LeaderElector{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+	}
+}
+
+// IsLeader also turns false once the renew deadline passed, even if Run has
+// not noticed yet
+func (e *LeaderElector) IsLeader() bool {
+	return e != nil && e.isLeader.Load() && time.Now().UnixNano() < e.leaderUntil.Load()
+}
+
+func (e *LeaderElector) getLeasePath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", e.namespace, e.name)
+}
+
+// tryAcquireOrRenew reports whether we hold the lease after the attempt
+func (e *LeaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	leaseDurationSeconds := int32(leaseDuration.Seconds())
+
+	var lease coordinationv1.Lease
+	err := e.client.Get(ctx, e.getLeasePath(), &lease)
+	if isNotFound(err) {
+		lease = coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: e.name, Namespace: e.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &e.identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+
+		err := e.client.Create(ctx, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.namespace), &lease)
+		if isConflict(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+
+	record := holder
+	if lease.Spec.RenewTime != nil {
+		record += "/" + lease.Spec.RenewTime.UTC().String()
+	}
+	if record != e.observedRecord {
+		e.observedRecord = record
+		e.observedTime = time.Now()
+	}
+
+	if holder != e.identity {
+		if holder != "" && time.Since(e.observedTime) < leaseDuration {
+			return false, nil
+		}
+
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.HolderIdentity = &e.identity
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.RenewTime = &now
+
+	// the update carries the resource version we read, so only one
+	// replica can win a race for the lease
+	err = e.client.Update(ctx, e.getLeasePath(), &lease)
+	if isConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release gives up the lease so another replica does not have to wait for
+// it to expire
+func (e *LeaderElector) release(ctx context.Context) error {
+	var lease coordinationv1.Lease
+	if err := e.client.Get(ctx, e.getLeasePath(), &lease); err != nil {
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != e.identity {
+		return nil
+	}
+
+	holder := ""
+	lease.Spec.HolderIdentity = &holder
+	return e.client.Update(ctx, e.getLeasePath(), &lease)
+}
+
+// renew tries to acquire or renew the lease once and updates the leadership
+func (e *LeaderElector) renew(ctx context.Context) {
+	// the lease is renewed with a time from before the request, so the
+	// deadline never ends later than the lease as others observe it
+	attemptTime := time.Now()
+	isLeader, err := e.tryAcquireOrRenew(ctx)
+	if err != nil && ctx.Err() == nil {
+		slog.Warn("Could not acquire or renew lease", "lease", e.namespace+"/"+e.name, "error", err)
+	}
+
+	if isLeader {
+		e.leaderUntil.Store(attemptTime.Add(leaseRenewDeadline).UnixNano())
+	} else if err != nil {
+		// a failed renewal keeps the leadership until the renew deadline
+		isLeader = e.IsLeader()
+	}
+
+	if isLeader != e.isLeader.Swap(isLeader) {
+		if isLeader {
+			slog.Info("Became leader", "lease", e.namespace+"/"+e.name, "identity", e.identity)
+		} else {
+			slog.Info("Lost leadership", "lease", e.namespace+"/"+e.name, "identity", e.identity)
+		}
+	}
+}
+
+// Run keeps trying to acquire or renew the lease until ctx is cancelled, and
+// releases it on the way out
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(leaseRenewPeriod)
+	defer ticker.Stop()
+
+	for {
+		e.renew(ctx)
+
+		select {
+		case <-ctx.Done():
+			if e.isLeader.Swap(false) {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), leaseRenewPeriod)
+				if err := e.release(releaseCtx); err != nil {
+					slog.Warn("Could not release lease", "lease", e.namespace+"/"+e.name, "error", err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+)
+
+// fakeLeaseServer stores a single lease and rejects writes with a stale
+// resource version like the api server
+type fakeLeaseServer struct {
+	mutex   sync.Mutex
+	lease   *coordinationv1.Lease
+	failing bool
+	updates int
+	// called before a write is checked, to write concurrently
+	beforeWrite func(lease *coordinationv1.Lease)
+}
+
+func (s *fakeLeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failing {
+		http.Error(w, "etcdserver: request timed out", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if s.lease == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s.lease)
+	case http.MethodPost, http.MethodPut:
+		var lease coordinationv1.Lease
+		json.NewDecoder(r.Body).Decode(&lease)
+		if s.beforeWrite != nil && s.lease != nil {
+			s.beforeWrite(s.lease)
+		}
+		if r.Method == http.MethodPost && s.lease != nil {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		if r.Method == http.MethodPut && (s.lease == nil || lease.ResourceVersion != s.lease.ResourceVersion) {
+			http.Error(w, "the object has been modified", http.StatusConflict)
+			return
+		}
+
+		version := 1
+		if s.lease != nil {
+			version, _ = strconv.Atoi(s.lease.ResourceVersion)
+			version++
+		}
+		lease.ResourceVersion = strconv.Itoa(version)
+		s.lease = &lease
+		s.updates++
+		json.NewEncoder(w).Encode(s.lease)
+	}
+}
+
+func (s *fakeLeaseServer) holder() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lease == nil || s.lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *s.lease.Spec.HolderIdentity
+}
+
+func (s *fakeLeaseServer) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+}
+
+func newTestLeaderElectors(t *testing.T, identities ...string) (*fakeLeaseServer, []*LeaderElector) {
+	leaseServer := &fakeLeaseServer{}
+	server := httptest.NewServer(leaseServer)
+	t.Cleanup(server.Close)
+
+	client := &KubeClient{BaseURL: server.URL, HTTPClient: server.Client()}
+	electors := make([]*LeaderElector, 0, len(identities))
+	for _, identity := range identities {
+		elector := NewLeaderElector(client, "webhook", "lease")
+		elector.identity = identity
+		electors = append(electors, elector)
+	}
+	return leaseServer, electors
+}
+
+func TestLeaderElectorAcquiresAndRenews(t *testing.T) {
+	leaseServer, electors := newTestLeaderElectors(t, "a")
+	ctx := context.Background()
+
+	electors[0].renew(ctx)
+	if !electors[0].IsLeader() || leaseServer.holder() != "a" {
+		t.Fatalf("Expected a to create and hold the lease, holder is %q", leaseServer.holder())
+	}
+	acquireTime := leaseServer.lease.Spec.AcquireTime
+
+	electors[0].renew(ctx)
+	if !electors[0].IsLeader() || leaseServer.updates != 2 {
+		t.Errorf("Expected a to renew the lease, got %d writes", leaseServer.updates)
+	}
+	if !leaseServer.lease.Spec.AcquireTime.Equal(acquireTime) || leaseServer.lease.Spec.LeaseTransitions != nil {
+		t.Errorf("Expected a renewal to keep the acquire time and transitions, got %+v", leaseServer.lease.Spec)
+	}
+}
+
+func TestLeaderElectorWaitsForObservedExpiry(t *testing.T) {
+	leaseServer, electors := newTestLeaderElectors(t, "a", "b")
+	ctx := context.Background()
+	a, b := electors[0], electors[1]
+
+	a.renew(ctx)
+	b.renew(ctx)
+	if b.IsLeader() || leaseServer.holder() != "a" {
+		t.Fatalf("Expected b to wait for the lease of a, holder is %q", leaseServer.holder())
+	}
+
+	// a renewal restarts the expiry, whatever the clocks say
+	b.observedTime = time.Now().Add(-leaseDuration)
+	a.renew(ctx)
+	b.renew(ctx)
+	if b.IsLeader() {
+		t.Fatal("Expected b to wait for the renewed lease of a")
+	}
+
+	// once the lease did not change for the lease duration b takes it over
+	b.observedTime = time.Now().Add(-leaseDuration)
+	b.renew(ctx)
+	if !b.IsLeader() || leaseServer.holder() != "b" {
+		t.Fatalf("Expected b to take over the expired lease, holder is %q", leaseServer.holder())
+	}
+	if transitions := leaseServer.lease.Spec.LeaseTransitions; transitions == nil || *transitions != 1 {
+		t.Errorf("Expected one lease transition, got %v", transitions)
+	}
+
+	// a finds out it lost the lease on its next attempt
+	a.renew(ctx)
+	if a.IsLeader() {
+		t.Error("Expected a to step down once b holds the lease")
+	}
+}
+
+func TestLeaderElectorLosesRace(t *testing.T) {
+	leaseServer, electors := newTestLeaderElectors(t, "a", "b")
+	ctx := context.Background()
+	a, b := electors[0], electors[1]
+
+	a.renew(ctx)
+	a.release(ctx)
+
+	// a takes the released lease back between the read and the write of b
+	leaseServer.beforeWrite = func(lease *coordinationv1.Lease) {
+		identity := "a"
+		lease.Spec.HolderIdentity = &identity
+		lease.ResourceVersion += "0"
+	}
+	isLeader, err := b.tryAcquireOrRenew(ctx)
+	if isLeader || err != nil {
+		t.Errorf("Expected a lost race to be no error and no leadership, got %v, %v", isLeader, err)
+	}
+	if leaseServer.holder() != "a" {
+		t.Errorf("Expected a to keep the lease, holder is %q", leaseServer.holder())
+	}
+}
+
+func TestLeaderElectorRelease(t *testing.T) {
+	leaseServer, electors := newTestLeaderElectors(t, "a", "b")
+	ctx := context.Background()
+	a, b := electors[0], electors[1]
+
+	a.renew(ctx)
+	b.renew(ctx)
+
+	// only the holder releases the lease
+	if err := b.release(ctx); err != nil || leaseServer.holder() != "a" {
+		t.Fatalf("Expected b to leave the lease of a alone, holder is %q, %v", leaseServer.holder(), err)
+	}
+	if err := a.release(ctx); err != nil || leaseServer.holder() != "" {
+		t.Fatalf("Expected a to release the lease, holder is %q, %v", leaseServer.holder(), err)
+	}
+
+	// a released lease is taken over without waiting for it to expire
+	b.renew(ctx)
+	if !b.IsLeader() || leaseServer.holder() != "b" {
+		t.Errorf("Expected b to take over the released lease, holder is %q", leaseServer.holder())
+	}
+}
+
+func TestLeaderElectorStepsDownAtRenewDeadline(t *testing.T) {
+	leaseServer, electors := newTestLeaderElectors(t, "a")
+	ctx := context.Background()
+	a := electors[0]
+
+	a.renew(ctx)
+	if until := time.Unix(0, a.leaderUntil.Load()); time.Until(until) > leaseRenewDeadline || leaseRenewDeadline >= leaseDuration {
+		t.Fatalf("Expected the leadership to end before the lease expires, ends at %v", until)
+	}
+
+	// a failed renewal keeps the leadership until the renew deadline
+	leaseServer.setFailing(true)
+	a.renew(ctx)
+	if !a.IsLeader() {
+		t.Fatal("Expected a to stay leader after one failed renewal")
+	}
+
+	// IsLeader turns false at the deadline even before the next attempt
+	a.leaderUntil.Store(time.Now().Add(-time.Millisecond).UnixNano())
+	if a.IsLeader() {
+		t.Fatal("Expected a to step down at the renew deadline")
+	}
+	a.renew(ctx)
+	if a.IsLeader() || a.isLeader.Load() {
+		t.Error("Expected a failed renewal after the deadline to step down")
+	}
+
+	// the lease is acquired again once the api server is back
+	leaseServer.setFailing(false)
+	a.renew(ctx)
+	if !a.IsLeader() {
+		t.Error("Expected a to renew the lease it still holds")
+	}
+}
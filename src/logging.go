@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+type LogOptions struct {
+	// json or text, only applied at startup
+	Format string `json:"format"`
+	// debug, info, warn or error, applied on reload
+	Level string `json:"level"`
+}
+
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var parsedLevel slog.Level
+	if err := parsedLevel.UnmarshalText([]byte(level)); err != nil {
+		return parsedLevel, fmt.Errorf("unknown log level %q", level)
+	}
+	return parsedLevel, nil
+}
+
+func (o *LogOptions) validate() error {
+	if o.Format != logFormatJSON && o.Format != logFormatText {
+		return fmt.Errorf("logging.format must be %s or %s, got %q", logFormatJSON, logFormatText, o.Format)
+	}
+
+	if _, err := parseLogLevel(o.Level); err != nil {
+		return fmt.Errorf("logging.level: %v", err)
+	}
+
+	return nil
+}
+
+// setupLogging replaces the default logger, which also sends the output of
+// the standard log package through the structured handler
+func setupLogging(logOptions *LogOptions) {
+	setLogLevel(logOptions)
+
+	handlerOptions := &slog.HandlerOptions{Level: logLevel}
+	if logOptions.Format == logFormatText {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, handlerOptions)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, handlerOptions)))
+	}
+}
+
+func setLogLevel(logOptions *LogOptions) {
+	// the options are validated before they are applied
+	level, _ := parseLogLevel(logOptions.Level)
+	logLevel.Set(level)
+}
+
+// getAdmissionLogger returns a logger with the fields every log line about
+// an admission request carries
+func getAdmissionLogger(admissionRequest *admissionv1.AdmissionRequest) *slog.Logger {
+	return slog.With(
+		"uid", admissionRequest.UID,
+		"kind", admissionRequest.Kind.Kind,
+		"namespace", admissionRequest.Namespace,
+		"name", admissionRequest.Name,
+		"operation", admissionRequest.Operation,
+		"dryRun", isDryRun(admissionRequest),
+	)
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"flag"
 	"time"
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,172 +18,171 @@ import (
 )
 
 type ServerOptions struct {
-	EnableTLS bool
-	CertFile string
-    KeyFile string
-	GracefulShutdownSeconds int
+	HTTPAddress string `json:"httpAddress"`
+	HTTPSAddress string `json:"httpsAddress"`
+	EnableTLS bool `json:"enableTLS"`
+	CertFile string `json:"certFile"`
+    KeyFile string `json:"keyFile"`
+	GracefulShutdownSeconds int `json:"gracefulShutdownSeconds"`
+	// /readyz fails for this many seconds before the server shuts down, so
+	// the pod is taken out of the service before it stops accepting requests
+	ShutdownDrainSeconds int `json:"shutdownDrainSeconds"`
+	// warnings are logged when the certificate expires within this many days
+	CertificateExpiryWarningDays int `json:"certificateExpiryWarningDays"`
+	// client certificates are required and verified against this CA bundle when set
+	ClientCAFile string `json:"clientCAFile"`
+	// common or dns names a client certificate must have one of, every client
+	// certificate signed by the CA is accepted if empty
+	AllowedClientNames []string `json:"allowedClientNames"`
+	// /status and /metrics are served over plain http on this address when set,
+	// instead of on the admission listener
+	HealthAddress string `json:"healthAddress"`
+	// "1.2" or "1.3"
+	TLSMinVersion string `json:"tlsMinVersion"`
+	// names of the TLS 1.2 cipher suites to accept, go's defaults if empty
+	TLSCipherSuites []string `json:"tlsCipherSuites"`
+	ReadHeaderTimeoutSeconds int `json:"readHeaderTimeoutSeconds"`
+	ReadTimeoutSeconds int `json:"readTimeoutSeconds"`
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds"`
+	IdleTimeoutSeconds int `json:"idleTimeoutSeconds"`
+	// larger admission reviews are rejected before they are decoded
+	MaxRequestBodyBytes int64 `json:"maxRequestBodyBytes"`
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	// log.Println(r.Method, r.URL)
 	respBytes, _ := json.Marshal(map[string]interface{}{"status": "ok"})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(respBytes)
 }
 
-func mutatePod(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Method, r.URL)
-
-	admissionReview, err := getAdmissionReviewFromRequest(r.Body)
-	if err != nil {
-		log.Printf(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
-
-	admissionRequest := admissionReview.Request
-	log.Printf("Processing request : %v", admissionRequest.UID)
-
-	pod, err := getPodFromAdmissionRequest(admissionRequest)
-	if err != nil {
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
-
-	mutationConfig, err := getMutationConfig(pod)
-	if err != nil {
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
-
-	log.Println(mutationConfig)
-	podPatch, err := getPodPatch(pod, mutationConfig)
-	if err != nil {
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
-	podPatchBytes, err := json.Marshal(podPatch)
-    if err != nil {
-		newErr := fmt.Errorf("Could not marshal pod patch into bytes -- possible formatting error: %v", err.Error())
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, newErr.Error())
-		http.Error(w, newErr.Error(), http.StatusInternalServerError)
-	}
-
-	// this needs to be copied cause admissionv1.PatchTypeJSONPatch is const
-	// taking the direct reference of that doesn't match type
-	patchType := admissionv1.PatchTypeJSONPatch
-	admissionResponse := &admissionv1.AdmissionResponse{
-		UID: admissionRequest.UID,
-		Allowed: true,
-		Patch: podPatchBytes,
-		PatchType: &patchType,
-	}
+func writeAdmissionReview(w http.ResponseWriter, logger *slog.Logger, admissionReview *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse) {
+	observeAdmissionResponse(w, admissionReview.Request, admissionResponse)
+	logger.Info("Admission request handled", "decision", getAdmissionOutcome(admissionResponse), "patchSize", len(admissionResponse.Patch))
 
+	// the review keeps its apiVersion, so the response has the version of
+	// the request
 	admissionReview.Request = nil
 	admissionReview.Response = admissionResponse
 
 	admissionReviewResponseBytes, err := json.Marshal(&admissionReview)
     if err != nil {
 		newErr := fmt.Errorf("Could not marshal admission review response into bytes -- possible formatting error: %v", err.Error())
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, newErr.Error())
+		logger.Error(newErr.Error())
 		http.Error(w, newErr.Error(), http.StatusInternalServerError)
+		return
 	}
 
     w.Header().Set("Content-Type", "application/json")
     w.Write(admissionReviewResponseBytes)
 }
 
-func mutateStatefulSet(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Method, r.URL)
-
-	admissionReview, err := getAdmissionReviewFromRequest(r.Body)
-	if err != nil {
-		log.Printf(err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
-
-	admissionRequest := admissionReview.Request
-	log.Printf("Processing request : %v", admissionRequest.UID)
-
-	statefulSet, err := getStatefulSetFromAdmissionRequest(admissionRequest)
-	if err != nil {
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
+// limitRequestBody rejects admission reviews larger than maxBytes before
+// they are decoded
+func limitRequestBody(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			slog.Warn("Admission review is too large", "url", r.URL.String(), "contentLength", r.ContentLength, "maxBytes", maxBytes)
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
 
-	_, err = getMutationConfig(statefulSet)
-	if err != nil {
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		// bodies without a content length fail to decode once they exceed the limit
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next(w, r)
 	}
+}
 
-	statefulSetPatch := getStatefulSetPatch(statefulSet)
-
-	statefulSetPatchBytes, err := json.Marshal(statefulSetPatch)
-    if err != nil {
-		newErr := fmt.Errorf("Could not marshal pod patch into bytes -- possible formatting error: %v", err.Error())
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, newErr.Error())
-		http.Error(w, newErr.Error(), http.StatusInternalServerError)
-	}
+// runServer serves tls with the certificate of certificateReloader, or plain
+// http if it is nil
+func runServer(serverOptions *ServerOptions, certificateReloader *CertificateReloader) {
+	mux := http.NewServeMux()
 
-	// this needs to be copied cause admissionv1.PatchTypeJSONPatch is const
-	// taking the direct reference of that doesn't match type
-	patchType := admissionv1.PatchTypeJSONPatch
-	admissionResponse := &admissionv1.AdmissionResponse{
-		UID: admissionRequest.UID,
-		Allowed: true,
-		Patch: statefulSetPatchBytes,
-		PatchType: &patchType,
+	// probes and prometheus can not present client certificates, so with a
+	// health address they get their own unauthenticated listener
+	healthMux := mux
+	if serverOptions.HealthAddress != "" {
+		healthMux = http.NewServeMux()
 	}
 
-	admissionReview.Request = nil
-	admissionReview.Response = admissionResponse
-
-	admissionReviewResponseBytes, err := json.Marshal(&admissionReview)
-    if err != nil {
-		newErr := fmt.Errorf("Could not marshal admission review response into bytes -- possible formatting error: %v", err.Error())
-		log.Printf("Request ID: %v - %v", admissionRequest.UID, newErr.Error())
-		http.Error(w, newErr.Error(), http.StatusInternalServerError)
+	healthMux.HandleFunc("/status", handleStatus)
+	healthMux.HandleFunc("GET /livez", handleHealthChecks(livenessChecks))
+	healthMux.HandleFunc("GET /readyz", handleHealthChecks(readinessChecks))
+	healthMux.HandleFunc("GET /metrics", handleMetrics)
+	// requests are routed to a mutator by their kind, the per resource paths
+	// are kept for webhook configurations of older releases
+	for _, handlerName := range append([]string{"mutate"}, mutators.HandlerNames()...) {
+		mux.HandleFunc("POST /"+handlerName, instrumentAdmissionHandler(handlerName, limitRequestBody(serverOptions.MaxRequestBodyBytes, serveAdmission(handlerName, mutators))))
 	}
 
-    w.Header().Set("Content-Type", "application/json")
-    w.Write(admissionReviewResponseBytes)
-}
-
-func runServer(serverOptions *ServerOptions) {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/status", handleStatus)
-	mux.HandleFunc("POST /mutate-pods", mutatePod)
-	mux.HandleFunc("POST /mutate-statefulsets", mutateStatefulSet)
-
-	port := 8080
+	serverAddress := serverOptions.HTTPAddress
 	protocol := "http"
-	if serverOptions.EnableTLS {
-		port = 8443
+	if certificateReloader != nil {
+		serverAddress = serverOptions.HTTPSAddress
 		protocol = "https"
 	}
 
-	serverAddress := fmt.Sprintf("0.0.0.0:%d", port)
+	// tls handshake errors, e.g. rejected client certificates, end up here
+	errorLog := slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
 
 	server := http.Server{
 		Addr: serverAddress,
 		Handler: mux,
+		ErrorLog: errorLog,
+		ReadHeaderTimeout: time.Duration(serverOptions.ReadHeaderTimeoutSeconds) * time.Second,
+		ReadTimeout: time.Duration(serverOptions.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout: time.Duration(serverOptions.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout: time.Duration(serverOptions.IdleTimeoutSeconds) * time.Second,
+	}
+
+	if certificateReloader != nil {
+		tlsConfig, err := newServerTLSConfig(serverOptions, certificateReloader)
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	listener, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		slog.Error("Could not listen", "address", serverAddress, "error", err)
+		return
 	}
 
 	// Channel to listen for errors from server
-	serverErrors := make(chan error, 1)
+	serverErrors := make(chan error, 2)
 	go func() {
-		log.Printf("Server running on %s://%s",protocol, serverAddress)
-		if serverOptions.EnableTLS {
-			serverErrors <- server.ListenAndServeTLS(serverOptions.CertFile, serverOptions.KeyFile)
+		slog.Info("Server running", "address", fmt.Sprintf("%s://%s", protocol, serverAddress), "clientCertificates", server.TLSConfig != nil && server.TLSConfig.ClientCAs != nil)
+		serving.Store(true)
+		if certificateReloader != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = server.ServeTLS(listener, "", "")
 		} else {
-			serverErrors <- server.ListenAndServe()
+			err = server.Serve(listener)
 		}
+		serving.Store(false)
+		serverErrors <- err
 	}()
 
+	servers := []*http.Server{&server}
+	if serverOptions.HealthAddress != "" {
+		healthServer := &http.Server{
+			Addr: serverOptions.HealthAddress,
+			Handler: healthMux,
+			ErrorLog: errorLog,
+			ReadHeaderTimeout: server.ReadHeaderTimeout,
+			ReadTimeout: server.ReadTimeout,
+			WriteTimeout: server.WriteTimeout,
+			IdleTimeout: server.IdleTimeout,
+		}
+		servers = append(servers, healthServer)
 
+		go func() {
+			slog.Info("Health server running", "address", fmt.Sprintf("http://%s", serverOptions.HealthAddress))
+			serverErrors <- healthServer.ListenAndServe()
+		}()
+	}
 
 	// Set up channel to listen for interrupt/terminate signals
 	stop := make(chan os.Signal, 1)
@@ -189,31 +190,113 @@ func runServer(serverOptions *ServerOptions) {
 
 	select {
 	case err := <-serverErrors:
-		log.Println("Server error:", err)
+		slog.Error("Server error", "error", err)
 
 	case sig := <-stop:
-		log.Println("Received signal:", sig)
+		slog.Info("Received signal", "signal", sig.String())
+
+		shuttingDown.Store(true)
+		if serverOptions.ShutdownDrainSeconds > 0 {
+			slog.Info("Draining before shutdown", "seconds", serverOptions.ShutdownDrainSeconds)
+			time.Sleep(time.Duration(serverOptions.ShutdownDrainSeconds) * time.Second)
+		}
 
 		// Graceful shutdown
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverOptions.GracefulShutdownSeconds) * time.Second)
 		defer cancel()
 
-		if err := server.Shutdown(ctx); err != nil {
-			log.Println("Graceful shutdown failed:", err)
-		} else {
-			log.Println("Server gracefully stopped")
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("Graceful shutdown failed", "address", server.Addr, "error", err)
+			} else {
+				slog.Info("Server gracefully stopped", "address", server.Addr)
+			}
 		}
 	}
 }
 
 func main() {
-	serverOptions := ServerOptions{}
-	flag.BoolVar(&serverOptions.EnableTLS, "enable-tls", false, "whether or not to enable TLS")
-	flag.StringVar(&serverOptions.CertFile, "cert-file", "./secrets/certs/tls.crt", "filepath to .crt file, ignored if tls is not enabled")
-	flag.StringVar(&serverOptions.KeyFile, "key-file", "./secrets/certs/tls.key", "filepath to .key file, ignored if tls is not enabled")
-	flag.IntVar(&serverOptions.GracefulShutdownSeconds, "graceful-shutdown-seconds", 5, "number of seconds to wait before graceful shutdown")
+	if len(os.Args) > 1 && os.Args[1] == "certgen" {
+		if err := runCertgen(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "preview" {
+		if err := runPreview(os.Args[2:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			var previewError *PreviewError
+			if errors.As(err, &previewError) {
+				os.Exit(previewError.ExitCode())
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	var configFile string
+	newServerFlagSet(flag.ExitOnError, defaultServerConfig(), &configFile).Parse(os.Args[1:])
+
+	serverConfig, err := loadServerConfig(configFile, os.Args[1:])
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	currentServerConfig.Store(serverConfig)
+	setupLogging(&serverConfig.Logging)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var kubeClient *KubeClient
+	if serverConfig.Caches.isEnabled() || serverConfig.Events.Enabled || serverConfig.Certificates.SelfManaged {
+		kubeClient, err = NewInClusterKubeClient()
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := startCaches(ctx, kubeClient, &serverConfig.Caches); err != nil {
+		slog.Error("Could not start caches", "error", err)
+		os.Exit(1)
+	}
+
+	startEventRecorder(ctx, kubeClient, &serverConfig.Events)
+	startTracer(ctx, &serverConfig.Tracing)
+
+	if configFile != "" {
+		go watchServerConfig(ctx, configFile, os.Args[1:])
+	}
+
+	var certificateReloader *CertificateReloader
+	if serverConfig.Certificates.SelfManaged {
+		certificateReloader, err = startCertificateManager(ctx, kubeClient, &serverConfig.Certificates, serverConfig.Server.CertificateExpiryWarningDays)
+		if err != nil {
+			slog.Error("Could not start certificate manager", "error", err)
+			os.Exit(1)
+		}
+	} else if serverConfig.Server.EnableTLS {
+		certificateReloader = NewCertificateReloader(serverConfig.Server.CertFile, serverConfig.Server.KeyFile, serverConfig.Server.CertificateExpiryWarningDays)
+	}
+
+	if certificateReloader != nil {
+		if err := certificateReloader.waitForCertificate(ctx, certificateWaitTimeout); err != nil {
+			slog.Error("Could not load serving certificate", "error", err)
+			os.Exit(1)
+		}
+		go certificateReloader.Run(ctx)
+		readinessChecks.Add("certificate", certificateReloader.checkCertificate)
+	}
+
+	readinessChecks.Add("config", checkConfig)
+	readinessChecks.Add("shutdown", checkShutdown)
+	livenessChecks.Add("server", checkServing)
 
-	flag.Parse()
+	runServer(&serverConfig.Server, certificateReloader)
 
-	runServer(&serverOptions)
+	cancel()
+	stopTracer()
 }
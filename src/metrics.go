@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const metricsPrefix = "statefulset_affinity_injector_"
+
+var admissionDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is anything that can write itself in the prometheus text format
+type metric interface {
+	write(writer *bufio.Writer)
+}
+
+// metricVec holds one series per combination of label values
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// only used by histograms
+	bucketCounts []uint64
+	count        uint64
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+var (
+	metricsRegistry []metric
+
+	admissionRequestsTotal  = newCounterVec("admission_requests_total", "Number of admission requests by handler, outcome and namespace.", "handler", "outcome", "namespace")
+	admissionDuration       = newHistogramVec("admission_duration_seconds", "Time taken to handle admission requests.", admissionDurationBuckets, "handler")
+	admissionFailuresTotal  = newCounterVec("admission_failures_total", "Number of admission requests answered according to the failure policy by handler and reason.", "handler", "reason")
+	configErrorsTotal       = newCounterVec("config_errors_total", "Number of mutation configs that could not be resolved or parsed.", "handler", "namespace")
+	shadowAdmissionsTotal   = newCounterVec("shadow_admissions_total", "Number of admission requests in shadow mode by handler and the decision that was not applied.", "handler", "decision")
+	injectedRequirements    = newCounterVec("injected_requirements_total", "Number of node selector requirements injected into pods by node label key and value.", "key", "value")
+	tlsCertificateExpiry    = newGaugeVec("tls_certificate_expiry_timestamp_seconds", "Expiry time of the serving certificate in seconds since the epoch.")
+	certificateReloadsTotal = newCounterVec("tls_certificate_reloads_total", "Number of times the serving certificate changed by result.", "result")
+)
+
+func newMetricVec(name string, help string, metricType string, labelNames []string) metricVec {
+	return metricVec{
+		name:       metricsPrefix + name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *metricVec {
+	counter := newMetricVec(name, help, "counter", labelNames)
+	metricsRegistry = append(metricsRegistry, &counter)
+	return &counter
+}
+
+func newGaugeVec(name string, help string, labelNames ...string) *metricVec {
+	gauge := newMetricVec(name, help, "gauge", labelNames)
+	metricsRegistry = append(metricsRegistry, &gauge)
+	return &gauge
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	histogram := &histogramVec{
+		metricVec: newMetricVec(name, help, "histogram", labelNames),
+		buckets:   buckets,
+	}
+	metricsRegistry = append(metricsRegistry, histogram)
+	return histogram
+}
+
+// getSeries must be called with the mutex held
+func (m *metricVec) getSeries(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		m.series[key] = series
+	}
+	return series
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Add(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.getSeries(labelValues).value += value
+}
+
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.getSeries(labelValues).value = value
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series := h.getSeries(labelValues)
+	if series.bucketCounts == nil {
+		series.bucketCounts = make([]uint64, len(h.buckets))
+	}
+
+	for index, bucket := range h.buckets {
+		if value <= bucket {
+			series.bucketCounts[index]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatLabels(labelNames []string, labelValues []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(labelNames)+1)
+	for index, labelName := range labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escapeLabelValue(labelValues[index])))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escapeLabelValue(extraValue)))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedSeries must be called with the mutex held
+func (m *metricVec) sortedSeries() []*metricSeries {
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]*metricSeries, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, m.series[key])
+	}
+	return series
+}
+
+func (m *metricVec) writeHeader(writer *bufio.Writer) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", m.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.help))
+	fmt.Fprintf(writer, "# TYPE %s %s\n", m.name, m.metricType)
+}
+
+func (m *metricVec) write(writer *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.writeHeader(writer)
+	for _, series := range m.sortedSeries() {
+		fmt.Fprintf(writer, "%s%s %s\n", m.name, formatLabels(m.labelNames, series.labelValues, "", ""), formatFloat(series.value))
+	}
+}
+
+func (h *histogramVec) write(writer *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.writeHeader(writer)
+	for _, series := range h.sortedSeries() {
+		for index, bucket := range h.buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, series.labelValues, "le", formatFloat(bucket)), series.bucketCounts[index])
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, series.labelValues, "le", "+Inf"), series.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, series.labelValues, "", ""), formatFloat(series.value))
+		fmt.Fprintf(writer, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, series.labelValues, "", ""), series.count)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	writer := bufio.NewWriter(w)
+	for _, registeredMetric := range metricsRegistry {
+		registeredMetric.write(writer)
+	}
+	writer.Flush()
+}
+
+// metricsResponseWriter lets writeAdmissionReview report the outcome of a
+// request to the middleware that records the request metrics
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	outcome     string
+	namespace   string
+	handlerName string
+}
+
+func (w *metricsResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func getAdmissionOutcome(admissionResponse *admissionv1.AdmissionResponse) string {
+	if !admissionResponse.Allowed {
+		return "denied"
+	}
+	if len(admissionResponse.Patch) > 0 {
+		return "mutated"
+	}
+	return "allowed"
+}
+
+func observeAdmissionResponse(w http.ResponseWriter, admissionRequest *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	if metricsWriter, ok := w.(*metricsResponseWriter); ok {
+		metricsWriter.outcome = getAdmissionOutcome(admissionResponse)
+		metricsWriter.namespace = admissionRequest.Namespace
+	}
+}
+
+// observeAdmissionHandler sets the handler label of the request metrics once
+// the mutator of the request is known
+func observeAdmissionHandler(w http.ResponseWriter, handlerName string) {
+	if metricsWriter, ok := w.(*metricsResponseWriter); ok {
+		metricsWriter.handlerName = handlerName
+	}
+}
+
+// observeAdmissionFailure records a request answered according to the
+// failure policy as an error, whatever the response was
+func observeAdmissionFailure(w http.ResponseWriter, handlerName string, reason string) {
+	admissionFailuresTotal.Inc(handlerName, reason)
+	if metricsWriter, ok := w.(*metricsResponseWriter); ok {
+		metricsWriter.outcome = "error"
+	}
+}
+
+func instrumentAdmissionHandler(handlerName string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metricsWriter := &metricsResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, handlerName: handlerName}
+
+		r, span := startServerSpan(r, handlerName)
+		defer span.End()
+
+		next(metricsWriter, r)
+
+		outcome := metricsWriter.outcome
+		if outcome == "" || metricsWriter.statusCode >= http.StatusBadRequest {
+			outcome = "error"
+			span.RecordError(fmt.Errorf("responded with status %d", metricsWriter.statusCode))
+		}
+		span.SetAttributes("http.response.status_code", metricsWriter.statusCode, "admission.outcome", outcome)
+
+		admissionRequestsTotal.Inc(metricsWriter.handlerName, outcome, metricsWriter.namespace)
+		admissionDuration.Observe(time.Since(start).Seconds(), metricsWriter.handlerName)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeMetric(m metric) string {
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	m.write(writer)
+	writer.Flush()
+	return buffer.String()
+}
+
+// metricValue returns the value of a series, 0 if it does not exist yet
+func metricValue(m *metricVec, labelValues ...string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.getSeries(labelValues).value
+}
+
+func TestCounterExposition(t *testing.T) {
+	counter := newMetricVec("requests_total", "Number of requests.\nBy \"handler\" and path \\.", "counter", []string{"handler", "path"})
+	counter.Inc("mutate", `C:\tmp`)
+	counter.Add(2.5, "mutate", "a\"b\nc")
+	counter.Inc("b", "/")
+	counter.Inc("b", "/")
+
+	expected := `# HELP statefulset_affinity_injector_requests_total Number of requests.\nBy "handler" and path \\.
+# TYPE statefulset_affinity_injector_requests_total counter
+statefulset_affinity_injector_requests_total{handler="b",path="/"} 2
+statefulset_affinity_injector_requests_total{handler="mutate",path="C:\\tmp"} 1
+statefulset_affinity_injector_requests_total{handler="mutate",path="a\"b\nc"} 2.5
+`
+	if got := writeMetric(&counter); got != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestGaugeWithoutLabelsExposition(t *testing.T) {
+	gauge := newMetricVec("expiry_timestamp_seconds", "Expiry.", "gauge", nil)
+	gauge.Set(1.7e9)
+
+	expected := `# HELP statefulset_affinity_injector_expiry_timestamp_seconds Expiry.
+# TYPE statefulset_affinity_injector_expiry_timestamp_seconds gauge
+statefulset_affinity_injector_expiry_timestamp_seconds 1.7e+09
+`
+	if got := writeMetric(&gauge); got != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	histogram := &histogramVec{
+		metricVec: newMetricVec("duration_seconds", "Duration.", "histogram", []string{"handler"}),
+		buckets:   []float64{0.01, 0.1, 1},
+	}
+	// the upper bound of a bucket is inclusive, 5 only lands in +Inf
+	for _, value := range []float64{0.0078125, 0.01, 0.0625, 1, 5} {
+		histogram.Observe(value, "mutate")
+	}
+	histogram.Observe(0.25, `a"b`)
+
+	expected := `# HELP statefulset_affinity_injector_duration_seconds Duration.
+# TYPE statefulset_affinity_injector_duration_seconds histogram
+statefulset_affinity_injector_duration_seconds_bucket{handler="a\"b",le="0.01"} 0
+statefulset_affinity_injector_duration_seconds_bucket{handler="a\"b",le="0.1"} 0
+statefulset_affinity_injector_duration_seconds_bucket{handler="a\"b",le="1"} 1
+statefulset_affinity_injector_duration_seconds_bucket{handler="a\"b",le="+Inf"} 1
+statefulset_affinity_injector_duration_seconds_sum{handler="a\"b"} 0.25
+statefulset_affinity_injector_duration_seconds_count{handler="a\"b"} 1
+statefulset_affinity_injector_duration_seconds_bucket{handler="mutate",le="0.01"} 2
+statefulset_affinity_injector_duration_seconds_bucket{handler="mutate",le="0.1"} 3
+statefulset_affinity_injector_duration_seconds_bucket{handler="mutate",le="1"} 4
+statefulset_affinity_injector_duration_seconds_bucket{handler="mutate",le="+Inf"} 5
+statefulset_affinity_injector_duration_seconds_sum{handler="mutate"} 6.0803125
+statefulset_affinity_injector_duration_seconds_count{handler="mutate"} 5
+`
+	if got := writeMetric(histogram); got != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Unexpected content type %q", contentType)
+	}
+
+	body, _ := io.ReadAll(recorder.Body)
+	types := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			types[strings.Fields(line)[2]]++
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, metricsPrefix) {
+			t.Errorf("Sample without the metrics prefix: %q", line)
+		}
+	}
+
+	for _, registeredMetric := range metricsRegistry {
+		var name string
+		switch typed := registeredMetric.(type) {
+		case *metricVec:
+			name = typed.name
+		case *histogramVec:
+			name = typed.name
+		}
+		if types[name] != 1 {
+			t.Errorf("Expected one TYPE line for %s, got %d", name, types[name])
+		}
+	}
+}
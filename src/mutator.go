@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Mutator mutates one kind of object. The registry routes admission requests
+// to it by the kind of their object, and the admission pipeline takes care of
+// everything that is not specific to the kind.
+type Mutator interface {
+	// GroupVersionKind is matched against the kind of admission requests
+	GroupVersionKind() schema.GroupVersionKind
+	// HandlerName is the path the mutator is also served on, and the handler
+	// label of the metrics of its requests whichever path they came in on
+	HandlerName() string
+	// Decode returns the object of an admission request
+	Decode(admissionRequest *admissionv1.AdmissionRequest) (K8sObject, error)
+	// Mutate returns the response to an admission request for the decoded
+	// object, usually with a patch. Errors are answered according to the
+	// failure policy.
+	Mutate(ctx context.Context, admission *Admission, object K8sObject) (*admissionv1.AdmissionResponse, error)
+}
+
+// mutators are the mutators the webhook serves
+var mutators = NewMutatorRegistry(PodMutator{}, StatefulSetMutator{})
+
+type MutatorRegistry struct {
+	mutators map[schema.GroupVersionKind]Mutator
+}
+
+func NewMutatorRegistry(mutators ...Mutator) *MutatorRegistry {
+	registry := &MutatorRegistry{mutators: make(map[schema.GroupVersionKind]Mutator)}
+	for _, mutator := range mutators {
+		registry.Register(mutator)
+	}
+	return registry
+}
+
+// Register adds a mutator, replacing any mutator of the same kind
+func (r *MutatorRegistry) Register(mutator Mutator) {
+	r.mutators[mutator.GroupVersionKind()] = mutator
+}
+
+func (r *MutatorRegistry) Get(gvk schema.GroupVersionKind) (Mutator, bool) {
+	mutator, ok := r.mutators[gvk]
+	return mutator, ok
+}
+
+// HandlerNames returns the handler names of the registered mutators, sorted
+func (r *MutatorRegistry) HandlerNames() []string {
+	handlerNames := make([]string, 0, len(r.mutators))
+	for _, mutator := range r.mutators {
+		handlerNames = append(handlerNames, mutator.HandlerName())
+	}
+	sort.Strings(handlerNames)
+	return handlerNames
+}
+
+func getRequestGroupVersionKind(admissionRequest *admissionv1.AdmissionRequest) schema.GroupVersionKind {
+	requestKind := admissionRequest.Kind
+	return schema.GroupVersionKind{Group: requestKind.Group, Version: requestKind.Version, Kind: requestKind.Kind}
+}
+
+// getHandlerName returns the handler name of the mutator an admission request
+// is dispatched to, or defaultName if there is none for its kind
+func (r *MutatorRegistry) getHandlerName(admissionRequest *admissionv1.AdmissionRequest, defaultName string) string {
+	if mutator, ok := r.Get(getRequestGroupVersionKind(admissionRequest)); ok {
+		return mutator.HandlerName()
+	}
+	return defaultName
+}
+
+// admit is the admitFunc that dispatches admission requests to the mutator
+// of their kind
+func (r *MutatorRegistry) admit(ctx context.Context, admission *Admission) (*admissionv1.AdmissionResponse, error) {
+	gvk := getRequestGroupVersionKind(admission.Request)
+
+	mutator, ok := r.Get(gvk)
+	if !ok {
+		return nil, fmt.Errorf("No mutator is registered for %s", gvk.String())
+	}
+
+	_, span := startSpan(ctx, "decode object")
+	object, err := mutator.Decode(admission.Request)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	return mutator.Mutate(ctx, admission, object)
+}
+
+// getPatchAdmissionResponse admits an object with a json patch
+func getPatchAdmissionResponse(admissionRequest *admissionv1.AdmissionRequest, patch []map[string]interface{}, auditAnnotations map[string]string) (*admissionv1.AdmissionResponse, error) {
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal patch into bytes -- possible formatting error: %v", err.Error())
+	}
+
+	// this needs to be copied cause admissionv1.PatchTypeJSONPatch is const
+	// taking the direct reference of that doesn't match type
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		UID:              admissionRequest.UID,
+		Allowed:          true,
+		Patch:            patchBytes,
+		PatchType:        &patchType,
+		AuditAnnotations: auditAnnotations,
+	}, nil
+}
+
+// PatchVerificationError is returned when a patch does not apply to the
+// object it was generated for, or does not have the intended effect
+type PatchVerificationError struct {
+	Err error
+}
+
+func (e *PatchVerificationError) Error() string {
+	return fmt.Sprintf("Patch verification failed: %v", e.Err)
+}
+
+func (e *PatchVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// applyPatch applies a patch to the raw object of an admission request like
+// the api server will and decodes the result with the mutator, so mutators
+// can check what their patch actually does before returning it
+func applyPatch(mutator Mutator, admissionRequest *admissionv1.AdmissionRequest, patch []map[string]interface{}) (K8sObject, error) {
+	patchedRaw, err := applyJSONPatch(admissionRequest.Object.Raw, patch)
+	if err != nil {
+		return nil, &PatchVerificationError{Err: err}
+	}
+
+	patchedRequest := *admissionRequest
+	patchedRequest.Object.Raw = patchedRaw
+	patchedRequest.Object.Object = nil
+	patchedObject, err := mutator.Decode(&patchedRequest)
+	if err != nil {
+		return nil, &PatchVerificationError{Err: fmt.Errorf("Could not decode patched object: %v", err)}
+	}
+	return patchedObject, nil
+}
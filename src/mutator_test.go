@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// mutateAndApply runs an admission request through a mutator and applies the
+// patch of the response to the object of the request like the api server
+func mutateAndApply(t *testing.T, mutator Mutator, admissionRequest *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, K8sObject) {
+	t.Helper()
+	object, err := mutator.Decode(admissionRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admission := &Admission{Request: admissionRequest, Logger: slog.Default(), ServerConfig: getServerConfig(), HandlerName: mutator.HandlerName()}
+	admissionResponse, err := mutator.Mutate(context.Background(), admission, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patch []map[string]interface{}
+	if len(admissionResponse.Patch) > 0 {
+		if err := json.Unmarshal(admissionResponse.Patch, &patch); err != nil {
+			t.Fatalf("Could not decode the patch %s: %v", admissionResponse.Patch, err)
+		}
+	}
+	patchedObject, err := applyPatch(mutator, admissionRequest, patch)
+	if err != nil {
+		t.Fatalf("Could not apply the patch %s: %v", admissionResponse.Patch, err)
+	}
+	return admissionResponse, patchedObject
+}
+
+// assertJSONEqual compares objects by their json encoding, which is what the
+// api server stores
+func assertJSONEqual(t *testing.T, got interface{}, expected interface{}) {
+	t.Helper()
+	gotBytes, _ := json.Marshal(got)
+	expectedBytes, _ := json.Marshal(expected)
+	if string(gotBytes) != string(expectedBytes) {
+		t.Errorf("Unexpected object\n%s\nexpected\n%s", gotBytes, expectedBytes)
+	}
+}
+
+func TestMutatorRegistryHandlerNames(t *testing.T) {
+	if handlerNames := fmt.Sprint(mutators.HandlerNames()); handlerNames != "[mutate-pods mutate-statefulsets]" {
+		t.Errorf("Unexpected handler names %s", handlerNames)
+	}
+}
+
+func TestMutatorRegistryDispatch(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+
+	invalidStatefulSet := newTestStatefulSet(map[string]string{
+		annotationKeys.Enabled: "true",
+		annotationKeys.Config:  "not json",
+	})
+	deployment := &appsv1.Deployment{}
+	deployment.Name = "web"
+	configHash, err := getMutationConfigHash(map[string][]string{testZoneKey: {"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		path             string
+		admissionRequest *admissionv1.AdmissionRequest
+		// the handler label the request is counted under
+		handlerName string
+		outcome     string
+		patched     bool
+		message     string
+		// only mutations carry audit annotations
+		auditAnnotations map[string]string
+	}{
+		{
+			name:             "pod",
+			path:             "mutate",
+			admissionRequest: newTestPodAdmissionRequest(t, newTestPod(t, newTestEnabledStatefulSet(), 1)),
+			handlerName:      "mutate-pods",
+			outcome:          "mutated",
+			patched:          true,
+			auditAnnotations: map[string]string{"ordinal": "1", "placement": testZoneKey + "=b", "config-source": "statefulset", "config-hash": configHash},
+		},
+		{
+			name:             "statefulset",
+			path:             "mutate",
+			admissionRequest: newTestStatefulSetAdmissionRequest(t, newTestEnabledStatefulSet()),
+			handlerName:      "mutate-statefulsets",
+			outcome:          "mutated",
+			patched:          true,
+			auditAnnotations: map[string]string{"config-source": "annotation", "config-hash": configHash},
+		},
+		{
+			name:             "statefulset with an invalid config",
+			path:             "mutate",
+			admissionRequest: newTestStatefulSetAdmissionRequest(t, invalidStatefulSet),
+			handlerName:      "mutate-statefulsets",
+			outcome:          "denied",
+			message:          "Error parsing",
+		},
+		{
+			// the kind of the request decides, not the path
+			name:             "pod on the statefulset path",
+			path:             "mutate-statefulsets",
+			admissionRequest: newTestPodAdmissionRequest(t, newTestPod(t, newTestEnabledStatefulSet(), 0)),
+			handlerName:      "mutate-pods",
+			outcome:          "mutated",
+			patched:          true,
+			auditAnnotations: map[string]string{"ordinal": "0", "placement": testZoneKey + "=a", "config-source": "statefulset", "config-hash": configHash},
+		},
+		{
+			name:             "unregistered kind",
+			path:             "mutate",
+			admissionRequest: newTestAdmissionRequest(t, deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"), "deployments"),
+			handlerName:      "mutate",
+			outcome:          "error",
+			message:          "No mutator is registered for apps/v1, Kind=Deployment",
+		},
+	}
+
+	failuresBefore := metricValue(admissionFailuresTotal, "mutate", "error")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestsBefore := map[string]float64{}
+			for _, handlerName := range []string{"mutate", "mutate-pods", "mutate-statefulsets"} {
+				requestsBefore[handlerName] = metricValue(admissionRequestsTotal, handlerName, test.outcome, "db")
+			}
+			configErrorsBefore := metricValue(configErrorsTotal, test.handlerName, "db")
+
+			handler := instrumentAdmissionHandler(test.path, serveAdmission(test.path, mutators))
+			admissionResponse := postAdmissionReview(t, handler, "/"+test.path, test.admissionRequest)
+
+			if test.outcome == "error" && (admissionResponse.Result == nil || admissionResponse.Result.Code != http.StatusInternalServerError) {
+				t.Errorf("Expected the failure policy to deny the request, got %+v", admissionResponse.Result)
+			}
+			if admissionResponse.UID != test.admissionRequest.UID {
+				t.Errorf("Expected the uid of the request, got %q", admissionResponse.UID)
+			}
+			if patched := len(admissionResponse.Patch) > 0; patched != test.patched || admissionResponse.Allowed != test.patched {
+				t.Errorf("Expected allowed and patched to be %v, got %+v", test.patched, admissionResponse)
+			}
+			if test.message != "" && (admissionResponse.Result == nil || !strings.Contains(admissionResponse.Result.Message, test.message)) {
+				t.Errorf("Expected a message containing %q, got %+v", test.message, admissionResponse.Result)
+			}
+			assertJSONEqual(t, admissionResponse.AuditAnnotations, test.auditAnnotations)
+
+			for handlerName, before := range requestsBefore {
+				expected := before
+				if handlerName == test.handlerName {
+					expected++
+				}
+				if value := metricValue(admissionRequestsTotal, handlerName, test.outcome, "db"); value != expected {
+					t.Errorf("Expected %v %s requests under %s, got %v", expected, test.outcome, handlerName, value)
+				}
+			}
+
+			expectedConfigErrors := configErrorsBefore
+			if test.outcome == "denied" {
+				expectedConfigErrors++
+			}
+			if value := metricValue(configErrorsTotal, test.handlerName, "db"); value != expectedConfigErrors {
+				t.Errorf("Expected %v config errors under %s, got %v", expectedConfigErrors, test.handlerName, value)
+			}
+		})
+	}
+
+	if value := metricValue(admissionFailuresTotal, "mutate", "error"); value != failuresBefore+1 {
+		t.Errorf("Expected the request of the unregistered kind to be counted as a failure under mutate, got %v", value-failuresBefore)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// getJSONPatch returns an RFC 6902 json patch that turns original into
+// modified. Mutators change a copy of the typed object and diff it against
+// the original, so both go through the same json encoding and only the
+// changes end up in the patch. Objects are diffed key by key in sorted order.
+// Arrays are diffed index by index between the items they start and end
+// with, adding or removing items where the lengths differ.
+func getJSONPatch(original interface{}, modified interface{}) ([]map[string]interface{}, error) {
+	originalValue, err := toJSONValue(original)
+	if err != nil {
+		return nil, err
+	}
+
+	modifiedValue, err := toJSONValue(modified)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffJSONValues("", originalValue, modifiedValue, make([]map[string]interface{}, 0)), nil
+}
+
+// toJSONValue converts an object to maps, slices and json numbers, which
+// keeps integers exact
+func toJSONValue(object interface{}) (interface{}, error) {
+	objectBytes, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal object into bytes -- possible formatting error: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(objectBytes))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("Could not decode object: %v", err)
+	}
+	return value, nil
+}
+
+func diffJSONValues(path string, original interface{}, modified interface{}, patch []map[string]interface{}) []map[string]interface{} {
+	switch originalValue := original.(type) {
+	case map[string]interface{}:
+		if modifiedValue, ok := modified.(map[string]interface{}); ok {
+			return diffJSONObjects(path, originalValue, modifiedValue, patch)
+		}
+	case []interface{}:
+		if modifiedValue, ok := modified.([]interface{}); ok {
+			return diffJSONArrays(path, originalValue, modifiedValue, patch)
+		}
+	}
+
+	if reflect.DeepEqual(original, modified) {
+		return patch
+	}
+	return append(patch, map[string]interface{}{"op": "replace", "path": path, "value": modified})
+}
+
+func diffJSONObjects(path string, original map[string]interface{}, modified map[string]interface{}, patch []map[string]interface{}) []map[string]interface{} {
+	for _, key := range getSortedKeys(original) {
+		if _, ok := modified[key]; !ok {
+			patch = append(patch, map[string]interface{}{"op": "remove", "path": path + "/" + escapeJSONPointer(key)})
+		}
+	}
+
+	for _, key := range getSortedKeys(modified) {
+		keyPath := path + "/" + escapeJSONPointer(key)
+		if originalValue, ok := original[key]; ok {
+			patch = diffJSONValues(keyPath, originalValue, modified[key], patch)
+		} else {
+			patch = append(patch, map[string]interface{}{"op": "add", "path": keyPath, "value": modified[key]})
+		}
+	}
+
+	return patch
+}
+
+func diffJSONArrays(path string, original []interface{}, modified []interface{}, patch []map[string]interface{}) []map[string]interface{} {
+	// items that are the same at the start or at the end of both arrays stay
+	// where they are, so adding or removing items in one place does not shift
+	// every item after them
+	prefix := 0
+	for prefix < len(original) && prefix < len(modified) && reflect.DeepEqual(original[prefix], modified[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < min(len(original), len(modified))-prefix && reflect.DeepEqual(original[len(original)-1-suffix], modified[len(modified)-1-suffix]) {
+		suffix++
+	}
+
+	originalEnd := len(original) - suffix
+	modifiedEnd := len(modified) - suffix
+	common := min(originalEnd, modifiedEnd)
+	for index := prefix; index < common; index++ {
+		patch = diffJSONValues(path+"/"+strconv.Itoa(index), original[index], modified[index], patch)
+	}
+
+	// removed from the back so the indices of the remaining items hold
+	for index := originalEnd - 1; index >= common; index-- {
+		patch = append(patch, map[string]interface{}{"op": "remove", "path": path + "/" + strconv.Itoa(index)})
+	}
+
+	for index := common; index < modifiedEnd; index++ {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": path + "/" + strconv.Itoa(index), "value": modified[index]})
+	}
+
+	return patch
+}
+
+// applyJSONPatch applies a json patch to a json document the way the api
+// server does, so the webhook can check its patches before returning them
+func applyJSONPatch(document []byte, patch []map[string]interface{}) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("Could not decode document: %v", err)
+	}
+
+	for index, operation := range patch {
+		op, _ := operation["op"].(string)
+		path, _ := operation["path"].(string)
+
+		value, err := toJSONValue(operation["value"])
+		if err != nil {
+			return nil, err
+		}
+
+		root, err = applyJSONPatchOperation(root, op, path, value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not apply patch operation %d (%s %s): %v", index, op, path, err)
+		}
+	}
+
+	patchedDocument, err := json.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal patched document into bytes -- possible formatting error: %v", err)
+	}
+	return patchedDocument, nil
+}
+
+// parseJSONPointer splits a json pointer into unescaped tokens
+func parseJSONPointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path must be empty or start with /")
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for index, token := range tokens {
+		tokens[index] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func getJSONArrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if index > length || (index == length && !allowEnd) {
+		return 0, fmt.Errorf("index %d is out of bounds for an array of length %d", index, length)
+	}
+	return index, nil
+}
+
+func applyJSONPatchOperation(root interface{}, op string, path string, value interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		switch op {
+		case "add", "replace":
+			return value, nil
+		case "test":
+			if !reflect.DeepEqual(root, value) {
+				return nil, fmt.Errorf("document does not match")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("operation %q is not supported on the whole document", op)
+		}
+	}
+
+	// walk to the parent of the target, which has to exist
+	parent := root
+	for depth, token := range tokens[:len(tokens)-1] {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			child, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("parent /%s does not exist", strings.Join(escapeJSONPointerTokens(tokens[:depth+1]), "/"))
+			}
+			parent = child
+		case []interface{}:
+			index, err := getJSONArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			parent = container[index]
+		default:
+			return nil, fmt.Errorf("parent /%s is not an object or array", strings.Join(escapeJSONPointerTokens(tokens[:depth+1]), "/"))
+		}
+	}
+
+	last := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		current, exists := container[last]
+		switch op {
+		case "add":
+			container[last] = value
+		case "replace", "remove", "test":
+			if !exists {
+				return nil, fmt.Errorf("%s does not exist", path)
+			}
+			if op == "replace" {
+				container[last] = value
+			} else if op == "remove" {
+				delete(container, last)
+			} else if !reflect.DeepEqual(current, value) {
+				return nil, fmt.Errorf("value does not match")
+			}
+		default:
+			return nil, fmt.Errorf("operation %q is not supported", op)
+		}
+		return root, nil
+	case []interface{}:
+		index, err := getJSONArrayIndex(last, len(container), op == "add")
+		if err != nil {
+			return nil, err
+		}
+
+		// arrays change length, so the array is replaced in its parent
+		var updated []interface{}
+		switch op {
+		case "add":
+			updated = append(container[:index:index], append([]interface{}{value}, container[index:]...)...)
+		case "replace":
+			container[index] = value
+			return root, nil
+		case "remove":
+			updated = append(container[:index:index], container[index+1:]...)
+		case "test":
+			if !reflect.DeepEqual(container[index], value) {
+				return nil, fmt.Errorf("value does not match")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("operation %q is not supported", op)
+		}
+
+		parentPath := "/" + strings.Join(escapeJSONPointerTokens(tokens[:len(tokens)-1]), "/")
+		if len(tokens) == 1 {
+			parentPath = ""
+		}
+		return applyJSONPatchOperation(root, "replace", parentPath, updated)
+	default:
+		return nil, fmt.Errorf("parent of %s is not an object or array", path)
+	}
+}
+
+func escapeJSONPointerTokens(tokens []string) []string {
+	escaped := make([]string, len(tokens))
+	for index, token := range tokens {
+		escaped[index] = escapeJSONPointer(token)
+	}
+	return escaped
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGetJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		patch    string
+	}{
+		{
+			name:     "unchanged",
+			original: `{"a":[1,{"b":"c"}],"d":null}`,
+			modified: `{"a":[1,{"b":"c"}],"d":null}`,
+			patch:    `[]`,
+		},
+		{
+			name:     "escaped keys",
+			original: `{"annotations":{"example.com/a~b":"1","c":"2"}}`,
+			modified: `{"annotations":{"example.com/a~b":"3","~1/x":"4"}}`,
+			patch:    `[{"op":"remove","path":"/annotations/c"},{"op":"replace","path":"/annotations/example.com~1a~0b","value":"3"},{"op":"add","path":"/annotations/~01~1x","value":"4"}]`,
+		},
+		{
+			name:     "append",
+			original: `{"a":[1,2]}`,
+			modified: `{"a":[1,2,3,4]}`,
+			patch:    `[{"op":"add","path":"/a/2","value":3},{"op":"add","path":"/a/3","value":4}]`,
+		},
+		{
+			name:     "prepend",
+			original: `{"a":["b","c","d"]}`,
+			modified: `{"a":["x","b","c","d"]}`,
+			patch:    `[{"op":"add","path":"/a/0","value":"x"}]`,
+		},
+		{
+			name:     "insert",
+			original: `{"a":["b","d"]}`,
+			modified: `{"a":["b","c","c","d"]}`,
+			patch:    `[{"op":"add","path":"/a/1","value":"c"},{"op":"add","path":"/a/2","value":"c"}]`,
+		},
+		{
+			name:     "append a repeated item",
+			original: `{"a":["b","b"]}`,
+			modified: `{"a":["b","b","b"]}`,
+			patch:    `[{"op":"add","path":"/a/2","value":"b"}]`,
+		},
+		{
+			name:     "remove from the end in reverse order",
+			original: `{"a":[1,2,3,4]}`,
+			modified: `{"a":[1]}`,
+			patch:    `[{"op":"remove","path":"/a/3"},{"op":"remove","path":"/a/2"},{"op":"remove","path":"/a/1"}]`,
+		},
+		{
+			name:     "remove from the start",
+			original: `{"a":[1,2,3,4]}`,
+			modified: `{"a":[3,4]}`,
+			patch:    `[{"op":"remove","path":"/a/1"},{"op":"remove","path":"/a/0"}]`,
+		},
+		{
+			name:     "replace and shrink",
+			original: `{"a":[1,2,3,9]}`,
+			modified: `{"a":[5,9]}`,
+			patch:    `[{"op":"replace","path":"/a/0","value":5},{"op":"remove","path":"/a/2"},{"op":"remove","path":"/a/1"}]`,
+		},
+		{
+			name:     "nested change in an array",
+			original: `{"a":[{"b":1,"c":[1]},{"b":2}]}`,
+			modified: `{"a":[{"b":1,"c":[1,2]},{"b":3}]}`,
+			patch:    `[{"op":"add","path":"/a/0/c/1","value":2},{"op":"replace","path":"/a/1/b","value":3}]`,
+		},
+		{
+			name:     "null to missing",
+			original: `{"a":null,"b":1}`,
+			modified: `{"b":1}`,
+			patch:    `[{"op":"remove","path":"/a"}]`,
+		},
+		{
+			name:     "missing to null",
+			original: `{"b":1}`,
+			modified: `{"a":null,"b":1}`,
+			patch:    `[{"op":"add","path":"/a","value":null}]`,
+		},
+		{
+			name:     "null to value and back",
+			original: `{"a":null,"b":{"c":1}}`,
+			modified: `{"a":{"c":1},"b":null}`,
+			patch:    `[{"op":"replace","path":"/a","value":{"c":1}},{"op":"replace","path":"/b","value":null}]`,
+		},
+		{
+			name:     "type change",
+			original: `{"a":{"b":1},"c":[1],"d":"1"}`,
+			modified: `{"a":[1],"c":{"b":1},"d":1}`,
+			patch:    `[{"op":"replace","path":"/a","value":[1]},{"op":"replace","path":"/c","value":{"b":1}},{"op":"replace","path":"/d","value":1}]`,
+		},
+		{
+			name:     "large integers stay exact",
+			original: `{"a":9007199254740993}`,
+			modified: `{"a":9007199254740995}`,
+			patch:    `[{"op":"replace","path":"/a","value":9007199254740995}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := json.RawMessage(test.original)
+			modified := json.RawMessage(test.modified)
+
+			patch, err := getJSONPatch(original, modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patchBytes, _ := json.Marshal(patch)
+			if string(patchBytes) != test.patch {
+				t.Errorf("Unexpected patch\n%s\nexpected\n%s", patchBytes, test.patch)
+			}
+
+			// the patch has to turn the original into the modified document
+			patched, err := applyJSONPatch([]byte(test.original), patch)
+			if err != nil {
+				t.Fatalf("Could not apply the patch: %v", err)
+			}
+			patchedValue, _ := toJSONValue(json.RawMessage(patched))
+			modifiedValue, _ := toJSONValue(modified)
+			patchedBytes, _ := json.Marshal(patchedValue)
+			modifiedBytes, _ := json.Marshal(modifiedValue)
+			if string(patchedBytes) != string(modifiedBytes) {
+				t.Errorf("Patched document\n%s\ndoes not match\n%s", patchedBytes, modifiedBytes)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	document := `{"a":{"b":[1,2]},"c~/d":1}`
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{name: "missing parent", patch: `[{"op":"add","path":"/x/y","value":1}]`},
+		{name: "replace missing key", patch: `[{"op":"replace","path":"/a/x","value":1}]`},
+		{name: "remove missing key", patch: `[{"op":"remove","path":"/x"}]`},
+		{name: "index out of bounds", patch: `[{"op":"add","path":"/a/b/3","value":1}]`},
+		{name: "replace past the end", patch: `[{"op":"replace","path":"/a/b/2","value":1}]`},
+		{name: "remove with the end token", patch: `[{"op":"remove","path":"/a/b/-"}]`},
+		{name: "leading zero index", patch: `[{"op":"remove","path":"/a/b/01"}]`},
+		{name: "unescaped key", patch: `[{"op":"remove","path":"/c~/d"}]`},
+		{name: "path without slash", patch: `[{"op":"add","path":"a","value":1}]`},
+		{name: "failed test", patch: `[{"op":"test","path":"/a/b/0","value":2}]`},
+		{name: "unsupported operation", patch: `[{"op":"move","from":"/a","path":"/b"}]`},
+		{name: "scalar parent", patch: `[{"op":"add","path":"/a/b/0/c","value":1}]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var patch []map[string]interface{}
+			if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+			if patched, err := applyJSONPatch([]byte(document), patch); err == nil {
+				t.Errorf("Expected the patch to be rejected, got %s", patched)
+			}
+		})
+	}
+
+	// escaped keys and the end token apply
+	var patch []map[string]interface{}
+	json.Unmarshal([]byte(`[{"op":"test","path":"/c~0~1d","value":1},{"op":"add","path":"/a/b/-","value":3},{"op":"remove","path":"/a/b/0"}]`), &patch)
+	patched, err := applyJSONPatch([]byte(document), patch)
+	if err != nil || string(patched) != `{"a":{"b":[2,3]},"c~/d":1}` {
+		t.Errorf("Unexpected result %s, %v", patched, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// PodMutator pins pods of statefulsets to the node labels of their ordinal
+type PodMutator struct{}
+
+func (PodMutator) GroupVersionKind() schema.GroupVersionKind {
+	return corev1.SchemeGroupVersion.WithKind("Pod")
+}
+
+func (PodMutator) HandlerName() string {
+	return "mutate-pods"
+}
+
+func (PodMutator) Decode(admissionRequest *admissionv1.AdmissionRequest) (K8sObject, error) {
+	return getPodFromAdmissionRequest(admissionRequest)
+}
+
+func (PodMutator) Mutate(ctx context.Context, admission *Admission, object K8sObject) (*admissionv1.AdmissionResponse, error) {
+	serverConfig := admission.ServerConfig
+	admissionRequest := admission.Request
+	pod := object.(*corev1.Pod)
+
+	if podIndex, err := getStatefulsetPodIndex(pod); err == nil {
+		admission.Logger = admission.Logger.With("ordinal", podIndex)
+		getSpan(ctx).SetAttributes("statefulset.ordinal", podIndex)
+	}
+	logger := admission.Logger
+
+	// events about dry run requests would describe pods that never exist
+	recorder := eventRecorder
+	if isDryRun(admissionRequest) {
+		recorder = nil
+	}
+	statefulSetReference := getStatefulSetOwnerReference(pod)
+
+	annotationKeys := getAnnotationKeys(serverConfig.Mutation.AnnotationDomain)
+	shadow := isShadowMode(serverConfig, pod, annotationKeys)
+	configCtx, span := startSpan(ctx, "resolve config")
+	mutationConfig, err := getMutationConfig(configCtx, pod, annotationKeys)
+	span.RecordError(err)
+	span.End()
+	// the request may have been given up on while the config was looked up,
+	// nothing is logged, counted or recorded for it then
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		logger.Warn("Could not get mutation config", "error", err)
+		configErrorsTotal.Inc(admission.HandlerName, admissionRequest.Namespace)
+		recorder.Eventf(statefulSetReference, corev1.EventTypeWarning, eventReasonInvalidConfig, "Could not inject affinity into pod %s: %v", pod.Name, err)
+		admissionResponse := getConfigErrorAdmissionResponse(admissionRequest, err, serverConfig.Mutation.ConfigErrorPolicy)
+		if shadow {
+			return getShadowAdmissionResponse(admission, pod, admissionResponse, nil, annotationKeys)
+		}
+		return admissionResponse, nil
+	}
+
+	if err := checkMutationPolicy(admissionRequest.Namespace, mutationConfig, &serverConfig.Policy); err != nil {
+		logger.Warn("Mutation config violates the webhook policy", "error", err)
+		recorder.Eventf(statefulSetReference, corev1.EventTypeWarning, eventReasonPolicyViolation, "Could not inject affinity into pod %s: %v", pod.Name, err)
+		admissionResponse := getDeniedAdmissionResponse(admissionRequest, err)
+		if shadow {
+			return getShadowAdmissionResponse(admission, pod, admissionResponse, nil, annotationKeys)
+		}
+		return admissionResponse, nil
+	}
+
+	logger.Debug("Resolved mutation config", "config", mutationConfig)
+	_, span = startSpan(ctx, "generate patch")
+	podPatch, err := getPodPatch(pod, mutationConfig)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	podIndex, _ := getStatefulsetPodIndex(pod)
+	podPlacement, _ := getPodPlacement(pod, mutationConfig)
+
+	_, span = startSpan(ctx, "verify patch")
+	err = verifyPodPatch(admissionRequest, podPatch, podPlacement)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// reinvocations see the pod after the first patch, and have nothing to
+	// record again
+	if len(podPatch) == 0 {
+		logger.Debug("Affinity is already injected", "placement", formatPodPlacement(podPlacement))
+		if shadow {
+			return getShadowAdmissionResponse(admission, pod, getAllowedAdmissionResponse(admissionRequest), nil, annotationKeys)
+		}
+		return getAllowedAdmissionResponse(admissionRequest), nil
+	}
+
+	auditAnnotations, err := getMutationAuditAnnotations(pod, mutationConfig, annotationKeys)
+	if err != nil {
+		return nil, err
+	}
+	auditAnnotations["ordinal"] = strconv.Itoa(podIndex)
+	auditAnnotations["placement"] = formatPodPlacement(podPlacement)
+
+	admissionResponse, err := getPatchAdmissionResponse(admissionRequest, podPatch, auditAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing is injected in shadow mode, so there is nothing to count or
+	// report as injected
+	if shadow {
+		return getShadowAdmissionResponse(admission, pod, admissionResponse, nil, annotationKeys)
+	}
+
+	for key, value := range podPlacement {
+		injectedRequirements.Inc(key, value)
+	}
+
+	recorder.Eventf(statefulSetReference, corev1.EventTypeNormal, eventReasonAffinityInjected, "Ordinal %d pinned to %s", podIndex, formatPodPlacement(podPlacement))
+	if serverConfig.Events.PodEvents {
+		podReference := getObjectReference(pod, "v1", "Pod")
+		podEventDelay := time.Duration(serverConfig.Events.PodEventDelaySeconds) * time.Second
+		recorder.EventAfterf(podEventDelay, podReference, corev1.EventTypeNormal, eventReasonAffinityInjected, "Pinned to %s", formatPodPlacement(podPlacement))
+	}
+
+	return admissionResponse, nil
+}
+
+// verifyPodPatch checks that the patched pod has a node selector term
+// requiring every node label of its placement. Node selector terms are ORed,
+// so required terms the pod already had still let it be scheduled outside
+// its placement, only the term of the webhook is checked.
+func verifyPodPatch(admissionRequest *admissionv1.AdmissionRequest, patch []map[string]interface{}, placement map[string]string) error {
+	patchedObject, err := applyPatch(PodMutator{}, admissionRequest, patch)
+	if err != nil {
+		return err
+	}
+	patchedPod := patchedObject.(*corev1.Pod)
+
+	affinity := patchedPod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return &PatchVerificationError{Err: fmt.Errorf("Patched pod has no required node affinity")}
+	}
+
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if nodeSelectorTermRequires(term, placement) {
+			return nil
+		}
+	}
+	return &PatchVerificationError{Err: fmt.Errorf("Patched pod has no node selector term requiring %s", formatPodPlacement(placement))}
+}
+
+func nodeSelectorTermRequires(term corev1.NodeSelectorTerm, placement map[string]string) bool {
+	for key, value := range placement {
+		found := false
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == key && expression.Operator == corev1.NodeSelectorOpIn && len(expression.Values) == 1 && expression.Values[0] == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
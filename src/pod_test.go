@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testZoneKey = "topology.kubernetes.io/zone"
+
+func requireZone(zone string) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: testZoneKey, Operator: corev1.NodeSelectorOpIn, Values: []string{zone}}}}
+}
+
+func TestPodPatchApplies(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+
+	diskTerm := corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "disktype", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd"}}}}
+	preferred := []corev1.PreferredSchedulingTerm{{Weight: 10, Preference: diskTerm}}
+
+	tests := []struct {
+		name     string
+		ordinal  int
+		affinity *corev1.Affinity
+		expected *corev1.Affinity
+		patched  bool
+	}{
+		{
+			name:    "pod without affinity",
+			ordinal: 1,
+			expected: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("b")}},
+			}},
+			patched: true,
+		},
+		{
+			name:    "pod with pod anti affinity and preferred node affinity",
+			ordinal: 2,
+			affinity: &corev1.Affinity{
+				NodeAffinity:    &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: preferred},
+				PodAntiAffinity: &corev1.PodAntiAffinity{},
+			},
+			expected: &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution:  &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("a")}},
+					PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+				},
+				PodAntiAffinity: &corev1.PodAntiAffinity{},
+			},
+			patched: true,
+		},
+		{
+			name:    "pod with a required term",
+			ordinal: 1,
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{diskTerm}},
+			}},
+			expected: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{diskTerm, requireZone("b")}},
+			}},
+			patched: true,
+		},
+		{
+			name:    "pod that is already pinned",
+			ordinal: 3,
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("b")}},
+			}},
+			expected: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("b")}},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newTestPod(t, newTestEnabledStatefulSet(), test.ordinal)
+			pod.Spec.Affinity = test.affinity
+
+			admissionResponse, patchedPod := mutateAndApply(t, PodMutator{}, newTestPodAdmissionRequest(t, pod))
+			if !admissionResponse.Allowed || (len(admissionResponse.Patch) > 0) != test.patched {
+				t.Errorf("Expected allowed with patch %v, got %+v", test.patched, admissionResponse)
+			}
+
+			// reinvocations record nothing again
+			var expectedAuditAnnotations map[string]string
+			if test.patched {
+				// ordinals take turns in the zones of the config
+				expectedAuditAnnotations = map[string]string{
+					"ordinal":       strconv.Itoa(test.ordinal),
+					"placement":     testZoneKey + "=" + []string{"a", "b"}[test.ordinal%2],
+					"config-source": "statefulset",
+					"config-hash":   pod.Annotations[getAnnotationKeys(defaultAnnotationDomain).ConfigHash],
+				}
+			}
+			assertJSONEqual(t, admissionResponse.AuditAnnotations, expectedAuditAnnotations)
+
+			// only the affinity changes
+			expected := pod.DeepCopy()
+			expected.Spec.Affinity = test.expected
+			assertJSONEqual(t, patchedPod, expected)
+		})
+	}
+}
+
+func TestVerifyPodPatchRejectsCorruptedPatches(t *testing.T) {
+	pod := newTestPod(t, newTestEnabledStatefulSet(), 1)
+	admissionRequest := newTestPodAdmissionRequest(t, pod)
+	placement := map[string]string{testZoneKey: "b"}
+
+	tests := []struct {
+		name    string
+		corrupt func(patch []map[string]interface{}) []map[string]interface{}
+		message string
+	}{
+		{
+			name: "missing parent",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				patch[0]["path"] = "/spec/missing/affinity"
+				return patch
+			},
+			message: "parent /spec/missing does not exist",
+		},
+		{
+			name: "wrong zone",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				patch[0]["value"] = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("a")}},
+				}}
+				return patch
+			},
+			message: "no node selector term requiring topology.kubernetes.io/zone=b",
+		},
+		{
+			name: "affinity removed again",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "remove", "path": "/spec/affinity/nodeAffinity"})
+			},
+			message: "no required node affinity",
+		},
+		{
+			name: "undecodable object",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "replace", "path": "/spec/containers", "value": "web"})
+			},
+			message: "Could not decode patched object",
+		},
+		{
+			name: "empty patch",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return nil
+			},
+			message: "no required node affinity",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := getPodPatch(pod, map[string][]string{testZoneKey: {"a", "b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyPodPatch(admissionRequest, patch, placement); err != nil {
+				t.Fatalf("The generated patch does not verify: %v", err)
+			}
+
+			err = verifyPodPatch(admissionRequest, test.corrupt(patch), placement)
+			var patchVerificationError *PatchVerificationError
+			if !errors.As(err, &patchVerificationError) {
+				t.Fatalf("Expected a PatchVerificationError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.message) {
+				t.Errorf("Expected an error containing %q, got %q", test.message, err.Error())
+			}
+		})
+	}
+}
+
+// corruptingPodMutator pins every pod to zone a, but verifies its patch
+// against the placement of the ordinal like PodMutator
+type corruptingPodMutator struct {
+	PodMutator
+}
+
+func (corruptingPodMutator) Mutate(ctx context.Context, admission *Admission, object K8sObject) (*admissionv1.AdmissionResponse, error) {
+	pod := object.(*corev1.Pod)
+	patch, err := getPodPatch(pod, map[string][]string{testZoneKey: {"a", "a"}})
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyPodPatch(admission.Request, patch, map[string]string{testZoneKey: "b"}); err != nil {
+		return nil, err
+	}
+	return getPatchAdmissionResponse(admission.Request, patch, nil)
+}
+
+func TestPatchVerificationFailurePolicy(t *testing.T) {
+	registry := NewMutatorRegistry(corruptingPodMutator{})
+	pod := newTestPod(t, newTestEnabledStatefulSet(), 1)
+
+	for _, failurePolicy := range []string{failurePolicyFail, failurePolicyIgnore} {
+		t.Run(failurePolicy, func(t *testing.T) {
+			serverConfig := defaultServerConfig()
+			serverConfig.Mutation.FailurePolicy = failurePolicy
+			useServerConfig(t, serverConfig)
+
+			before := metricValue(admissionFailuresTotal, "mutate-pods", "verification")
+			admissionResponse := postAdmissionReview(t, serveAdmission("mutate", registry), "/mutate", newTestPodAdmissionRequest(t, pod))
+
+			if len(admissionResponse.Patch) > 0 {
+				t.Errorf("Expected no patch, got %s", admissionResponse.Patch)
+			}
+			if failurePolicy == failurePolicyFail {
+				if admissionResponse.Allowed || admissionResponse.Result == nil || admissionResponse.Result.Code != http.StatusInternalServerError || !strings.Contains(admissionResponse.Result.Message, "Patch verification failed") {
+					t.Errorf("Expected the pod to be denied, got %+v", admissionResponse)
+				}
+			} else if !admissionResponse.Allowed || len(admissionResponse.Warnings) != 1 || !strings.Contains(admissionResponse.Warnings[0], "Patch verification failed") {
+				t.Errorf("Expected the pod to be admitted with a warning, got %+v", admissionResponse)
+			}
+
+			if value := metricValue(admissionFailuresTotal, "mutate-pods", "verification"); value != before+1 {
+				t.Errorf("Expected the failed verification to be counted, got %v", value-before)
+			}
+		})
+	}
+}
+
+func TestPodLabelOptIn(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+
+	// a statefulset that opts in with the label passes it on to its pods, so
+	// they match an objectSelector on the label too
+	statefulSet := newTestStatefulSet(map[string]string{annotationKeys.Config: testMutationConfig})
+	statefulSet.Labels = map[string]string{annotationKeys.Enabled: "true"}
+	pod := newTestPod(t, statefulSet, 1)
+	if pod.Labels[annotationKeys.Enabled] != "true" || pod.Labels["app"] != "web" {
+		t.Fatalf("Expected the pod to get the opt-in label next to its own labels, got %v", pod.Labels)
+	}
+
+	// the label alone is enough for the pod mutator
+	delete(pod.Annotations, annotationKeys.Enabled)
+	admissionResponse, patchedPod := mutateAndApply(t, PodMutator{}, newTestPodAdmissionRequest(t, pod))
+	if !admissionResponse.Allowed || len(admissionResponse.Patch) == 0 {
+		t.Fatalf("Expected the pod to be patched, got %+v", admissionResponse)
+	}
+	expected := pod.DeepCopy()
+	expected.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{requireZone("b")}},
+	}}
+	assertJSONEqual(t, patchedPod, expected)
+
+	// pods of statefulsets that opt in with the annotation get no label
+	pod = newTestPod(t, newTestEnabledStatefulSet(), 1)
+	if _, ok := pod.Labels[annotationKeys.Enabled]; ok {
+		t.Errorf("Expected no opt-in label on the pod, got %v", pod.Labels)
+	}
+}
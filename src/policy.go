@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// PolicyOptions restrict what users can do with the webhook, regardless of
+// how the webhook configuration in the cluster selects objects
+type PolicyOptions struct {
+	// objects in these namespaces are admitted without changes
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+	// node label keys a config may use, all keys are allowed if empty
+	AllowedKeys []string `json:"allowedKeys"`
+	// namespace -> node label key -> values a config in that namespace may
+	// use, keys that are not listed for a namespace are not restricted
+	AllowedValues map[string]map[string][]string `json:"allowedValues"`
+}
+
+// PolicyError is returned when a mutation config is valid but not allowed
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+func isNamespaceExcluded(namespace string, policyOptions *PolicyOptions) bool {
+	return slices.Contains(policyOptions.ExcludedNamespaces, namespace)
+}
+
+func checkMutationPolicy(namespace string, mutationConfig map[string][]string, policyOptions *PolicyOptions) error {
+	// sorted so the same config always reports the same violation
+	for _, key := range getSortedKeys(mutationConfig) {
+		if len(policyOptions.AllowedKeys) > 0 && !slices.Contains(policyOptions.AllowedKeys, key) {
+			return &PolicyError{
+				Message: fmt.Sprintf("Node label %s is not allowed by the webhook policy, allowed node labels are: %s", key, strings.Join(policyOptions.AllowedKeys, ", ")),
+			}
+		}
+
+		allowedValues, ok := policyOptions.AllowedValues[namespace][key]
+		if !ok {
+			continue
+		}
+
+		for _, value := range mutationConfig[key] {
+			if !slices.Contains(allowedValues, value) {
+				return &PolicyError{
+					Message: fmt.Sprintf("Value %s for node label %s is not allowed in namespace %s by the webhook policy, allowed values are: %s", value, key, namespace, strings.Join(allowedValues, ", ")),
+				}
+			}
+		}
+	}
+
+	return nil
+}
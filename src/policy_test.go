@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckMutationPolicy(t *testing.T) {
+	policyOptions := &PolicyOptions{
+		AllowedKeys: []string{testZoneKey, "kubernetes.io/hostname"},
+		AllowedValues: map[string]map[string][]string{
+			"db": {testZoneKey: {"a", "b"}},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		namespace      string
+		mutationConfig map[string][]string
+		policyOptions  *PolicyOptions
+		// the error message, empty if the config is allowed
+		message string
+	}{
+		{
+			name:           "empty policy allows everything",
+			namespace:      "db",
+			mutationConfig: map[string][]string{"node.example.com/rack": {"r1"}},
+			policyOptions:  &PolicyOptions{},
+		},
+		{
+			name:           "allowed key and values",
+			namespace:      "db",
+			mutationConfig: map[string][]string{testZoneKey: {"a", "b"}},
+		},
+		{
+			name:           "key without allowed values in the namespace",
+			namespace:      "db",
+			mutationConfig: map[string][]string{"kubernetes.io/hostname": {"node-1"}},
+		},
+		{
+			name:           "values are only restricted in their namespace",
+			namespace:      "web",
+			mutationConfig: map[string][]string{testZoneKey: {"c"}},
+		},
+		{
+			name:           "key not allowed",
+			namespace:      "db",
+			mutationConfig: map[string][]string{testZoneKey: {"a"}, "node.example.com/rack": {"r1"}},
+			message:        "Node label node.example.com/rack is not allowed by the webhook policy, allowed node labels are: " + testZoneKey + ", kubernetes.io/hostname",
+		},
+		{
+			name:           "value not allowed",
+			namespace:      "db",
+			mutationConfig: map[string][]string{testZoneKey: {"a", "c"}},
+			message:        "Value c for node label " + testZoneKey + " is not allowed in namespace db by the webhook policy, allowed values are: a, b",
+		},
+		{
+			name:           "first violation in key order",
+			namespace:      "db",
+			mutationConfig: map[string][]string{testZoneKey: {"c"}, "a.example.com/key": {"x"}, "z.example.com/key": {"y"}},
+			message:        "Node label a.example.com/key is not allowed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.policyOptions == nil {
+				test.policyOptions = policyOptions
+			}
+
+			err := checkMutationPolicy(test.namespace, test.mutationConfig, test.policyOptions)
+			if test.message == "" {
+				if err != nil {
+					t.Errorf("Expected the config to be allowed, got %v", err)
+				}
+				return
+			}
+
+			var policyError *PolicyError
+			if !errors.As(err, &policyError) {
+				t.Fatalf("Expected a PolicyError, got %v", err)
+			}
+			if !strings.HasPrefix(err.Error(), test.message) {
+				t.Errorf("Expected an error starting with %q, got %q", test.message, err.Error())
+			}
+		})
+	}
+}
+
+func TestIsNamespaceExcluded(t *testing.T) {
+	policyOptions := &PolicyOptions{ExcludedNamespaces: []string{"kube-system", "monitoring"}}
+	for namespace, expected := range map[string]bool{"kube-system": true, "monitoring": true, "db": false, "": false} {
+		if excluded := isNamespaceExcluded(namespace, policyOptions); excluded != expected {
+			t.Errorf("Expected namespace %q to be excluded %v, got %v", namespace, expected, excluded)
+		}
+	}
+
+	if isNamespaceExcluded("kube-system", &PolicyOptions{}) {
+		t.Error("Expected no namespace to be excluded by an empty policy")
+	}
+}
+
+func TestPolicyIsEnforcedOnAdmission(t *testing.T) {
+	handler := serveAdmission("mutate", mutators)
+	admissionRequest := newTestStatefulSetAdmissionRequest(t, newTestEnabledStatefulSet())
+
+	// objects in excluded namespaces are admitted without looking at them
+	serverConfig := defaultServerConfig()
+	serverConfig.Policy.ExcludedNamespaces = []string{"db"}
+	useServerConfig(t, serverConfig)
+	admissionResponse := postAdmissionReview(t, handler, "/mutate", admissionRequest)
+	if !admissionResponse.Allowed || len(admissionResponse.Patch) != 0 {
+		t.Errorf("Expected the statefulset in an excluded namespace to be admitted unchanged, got %+v", admissionResponse)
+	}
+
+	// configs violating the policy are denied
+	serverConfig = defaultServerConfig()
+	serverConfig.Policy.AllowedValues = map[string]map[string][]string{"db": {testZoneKey: {"a"}}}
+	useServerConfig(t, serverConfig)
+	admissionResponse = postAdmissionReview(t, handler, "/mutate", admissionRequest)
+	if admissionResponse.Allowed || admissionResponse.Result == nil || !strings.Contains(admissionResponse.Result.Message, "Value b for node label "+testZoneKey) {
+		t.Errorf("Expected the statefulset to be denied by the policy, got %+v", admissionResponse)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	yaml "go.yaml.in/yaml/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// previewExitCodeUnresolved is the exit code of the preview when no
+// statefulset would be rejected but some need the cluster to be resolved
+const previewExitCodeUnresolved = 3
+
+type PreviewOptions struct {
+	AnnotationDomain string
+	Namespace        string
+	// Replicas overrides the replicas of the statefulsets when not negative
+	Replicas int
+	// ConfigFile is the server config whose policy is applied
+	ConfigFile string
+}
+
+// UnresolvedConfigError is returned when the mutation config of an object
+// depends on the cluster, which the preview can not read
+type UnresolvedConfigError struct {
+	Message string
+}
+
+func (e *UnresolvedConfigError) Error() string {
+	return e.Message
+}
+
+// PreviewError summarizes the statefulsets that could not be previewed
+type PreviewError struct {
+	Found      int
+	Rejected   int
+	Unresolved int
+}
+
+func (e *PreviewError) Error() string {
+	messages := make([]string, 0, 2)
+	if e.Rejected > 0 {
+		messages = append(messages, fmt.Sprintf("%d of %d statefulsets would be rejected", e.Rejected, e.Found))
+	}
+	if e.Unresolved > 0 {
+		messages = append(messages, fmt.Sprintf("%d of %d statefulsets are unresolved and need the cluster", e.Unresolved, e.Found))
+	}
+	return strings.Join(messages, ", ")
+}
+
+// ExitCode is 1 if any statefulset would be rejected, an unresolved config
+// may be fine once it is applied
+func (e *PreviewError) ExitCode() int {
+	if e.Rejected > 0 {
+		return 1
+	}
+	return previewExitCodeUnresolved
+}
+
+func newPreviewFlagSet(options *PreviewOptions) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("preview", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s preview [flags] [FILE...]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flagSet.Output(), "Prints the node labels each ordinal of the statefulsets in the yaml or json manifests is pinned to.\n")
+		fmt.Fprintf(flagSet.Output(), "Manifests are read from stdin when no file or - is given. Statefulsets that rely on namespace\n")
+		fmt.Fprintf(flagSet.Output(), "default configs or ConfigMap references need the cluster and are reported as unresolved.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Exits with 1 if a statefulset would be rejected and with %d if some are only unresolved.\n\n", previewExitCodeUnresolved)
+		flagSet.PrintDefaults()
+	}
+
+	flagSet.StringVar(&options.AnnotationDomain, "annotation-domain", defaultAnnotationDomain, "prefix of the annotations the webhook reads")
+	flagSet.StringVar(&options.Namespace, "namespace", "default", "namespace of statefulsets without one")
+	flagSet.IntVar(&options.Replicas, "replicas", -1, "number of ordinals to preview instead of the replicas of each statefulset")
+	flagSet.StringVar(&options.ConfigFile, "config", "", "filepath to the server config file of the webhook, whose policy and annotation domain are applied")
+	return flagSet
+}
+
+// readManifests returns the json of every document in a stream of yaml or
+// json manifests, with the items of lists as separate documents
+func readManifests(reader io.Reader) ([][]byte, error) {
+	var manifests [][]byte
+	decoder := yaml.NewDecoder(reader)
+	for {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			return manifests, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		converted, err := convertYAMLToJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		manifests, err = appendManifest(manifests, converted)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func appendManifest(manifests [][]byte, value interface{}) ([][]byte, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		// empty documents between separators decode to nil
+		return manifests, nil
+	}
+
+	if kind, _ := object["kind"].(string); strings.HasSuffix(kind, "List") {
+		items, _ := object["items"].([]interface{})
+		for _, item := range items {
+			var err error
+			if manifests, err = appendManifest(manifests, item); err != nil {
+				return nil, err
+			}
+		}
+		return manifests, nil
+	}
+
+	manifest, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return append(manifests, manifest), nil
+}
+
+// getStatefulSetFromManifest returns the statefulset of a manifest, or nil
+// if the manifest is of another kind
+func getStatefulSetFromManifest(manifest []byte) (*appsv1.StatefulSet, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(manifest, &typeMeta); err != nil {
+		return nil, err
+	}
+	if typeMeta.GroupVersionKind() != appsv1.SchemeGroupVersion.WithKind("StatefulSet") {
+		return nil, nil
+	}
+
+	var statefulSet appsv1.StatefulSet
+	if err := json.Unmarshal(manifest, &statefulSet); err != nil {
+		return nil, fmt.Errorf("Failed to parse statefulset: %v", err)
+	}
+	return &statefulSet, nil
+}
+
+// checkMutationConfigResolvable returns an UnresolvedConfigError if the
+// mutation config of an opted in object comes from the cluster
+func checkMutationConfigResolvable(object K8sObject, annotationKeys AnnotationKeys) error {
+	if !isMutationEnabled(object, annotationKeys) {
+		return nil
+	}
+
+	mutationConfigAnnotation, ok := object.GetAnnotations()[annotationKeys.Config]
+	if !ok {
+		return &UnresolvedConfigError{
+			Message: fmt.Sprintf("No \"%s\" annotation, the config depends on the default config of namespace %s", annotationKeys.Config, object.GetNamespace()),
+		}
+	}
+	// malformed references are rejected without looking at the cluster
+	location, key, ok := strings.Cut(strings.TrimPrefix(mutationConfigAnnotation, configMapReferencePrefix), "#")
+	if strings.HasPrefix(mutationConfigAnnotation, configMapReferencePrefix) && ok && location != "" && key != "" {
+		return &UnresolvedConfigError{
+			Message: fmt.Sprintf("The config is read from %s", describeMutationConfigValue(mutationConfigAnnotation, object.GetNamespace(), "annotation")),
+		}
+	}
+	return nil
+}
+
+// previewStatefulSet runs a statefulset and the pods of its ordinals through
+// the same steps the webhook does and returns where each ordinal is pinned
+func previewStatefulSet(ctx context.Context, statefulSet *appsv1.StatefulSet, replicas int, annotationKeys AnnotationKeys, policyOptions *PolicyOptions) ([]OrdinalPlacement, error) {
+	if err := checkMutationConfigResolvable(statefulSet, annotationKeys); err != nil {
+		return nil, err
+	}
+
+	mutationConfig, err := getMutationConfig(ctx, statefulSet, annotationKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMutationPolicy(statefulSet.Namespace, mutationConfig, policyOptions); err != nil {
+		return nil, err
+	}
+
+	// the pods are created from the template as the webhook patches it
+	mutatedStatefulSet := statefulSet.DeepCopy()
+	if err := injectStatefulSetAnnotations(mutatedStatefulSet, mutationConfig, annotationKeys); err != nil {
+		return nil, err
+	}
+
+	return getStatefulSetPlacements(ctx, mutatedStatefulSet, replicas, annotationKeys)
+}
+
+func writeOrdinalPlacements(w io.Writer, statefulSet *appsv1.StatefulSet, previews []OrdinalPlacement) error {
+	keys := []string{}
+	if len(previews) > 0 {
+		keys = getSortedKeys(previews[0].Placement)
+	}
+
+	fmt.Fprintf(w, "StatefulSet %s/%s\n", statefulSet.Namespace, statefulSet.Name)
+	tabWriter := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "ORDINAL\tPOD\t"+strings.Join(keys, "\t"))
+	for _, preview := range previews {
+		values := make([]string, 0, len(keys))
+		for _, key := range keys {
+			values = append(values, preview.Placement[key])
+		}
+		fmt.Fprintf(tabWriter, "%d\t%s\t%s\n", preview.Ordinal, preview.Pod, strings.Join(values, "\t"))
+	}
+	if err := tabWriter.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// runPreview prints the placement of every ordinal of the statefulsets in
+// the manifests. Statefulsets the webhook would reject or whose config needs
+// the cluster are reported and make it fail with a PreviewError once all
+// manifests are read.
+func runPreview(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	options := &PreviewOptions{}
+	flagSet := newPreviewFlagSet(options)
+	flagSet.Parse(args)
+
+	serverConfig, err := loadServerConfig(options.ConfigFile, nil)
+	if err != nil {
+		return err
+	}
+	// the annotation domain of the server config applies unless it is given
+	annotationDomain := serverConfig.Mutation.AnnotationDomain
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == "annotation-domain" {
+			annotationDomain = options.AnnotationDomain
+		}
+	})
+
+	paths := flagSet.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	var manifests [][]byte
+	for _, path := range paths {
+		reader := stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("Could not open manifest %s: %v", path, err)
+			}
+			defer file.Close()
+			reader = file
+		}
+
+		fileManifests, err := readManifests(reader)
+		if err != nil {
+			return fmt.Errorf("Could not read manifests from %s: %v", path, err)
+		}
+		manifests = append(manifests, fileManifests...)
+	}
+
+	ctx := context.Background()
+	annotationKeys := getAnnotationKeys(annotationDomain)
+	previewError := &PreviewError{}
+	for _, manifest := range manifests {
+		statefulSet, err := getStatefulSetFromManifest(manifest)
+		if err != nil {
+			return fmt.Errorf("Could not parse manifest: %v", err)
+		}
+		if statefulSet == nil {
+			continue
+		}
+		previewError.Found++
+
+		if statefulSet.Namespace == "" {
+			statefulSet.Namespace = options.Namespace
+		}
+
+		replicas := getStatefulSetReplicas(statefulSet)
+		if options.Replicas >= 0 {
+			replicas = options.Replicas
+		}
+
+		if isNamespaceExcluded(statefulSet.Namespace, &serverConfig.Policy) {
+			fmt.Fprintf(stderr, "StatefulSet %s/%s is in an excluded namespace and is not mutated\n\n", statefulSet.Namespace, statefulSet.Name)
+			continue
+		}
+
+		previews, err := previewStatefulSet(ctx, statefulSet, replicas, annotationKeys, &serverConfig.Policy)
+		var unresolvedConfigError *UnresolvedConfigError
+		if errors.As(err, &unresolvedConfigError) {
+			fmt.Fprintf(stderr, "StatefulSet %s/%s is unresolved (needs cluster): %v\n\n", statefulSet.Namespace, statefulSet.Name, err)
+			previewError.Unresolved++
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "StatefulSet %s/%s would be rejected: %v\n\n", statefulSet.Namespace, statefulSet.Name, err)
+			previewError.Rejected++
+			continue
+		}
+
+		if err := writeOrdinalPlacements(stdout, statefulSet, previews); err != nil {
+			return err
+		}
+	}
+
+	if previewError.Found == 0 {
+		return fmt.Errorf("No statefulsets found in the manifests")
+	}
+	if previewError.Rejected > 0 || previewError.Unresolved > 0 {
+		return previewError
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestStatefulSetManifest(namespace string, name string, annotationDomain string, config string) string {
+	manifest := fmt.Sprintf(`apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: %s
+  namespace: %s
+  annotations:
+    %s/enabled: "true"
+`, name, namespace, annotationDomain)
+	if config != "" {
+		manifest += fmt.Sprintf("    %s/config: '%s'\n", annotationDomain, config)
+	}
+	return manifest + "spec:\n  replicas: 2\n"
+}
+
+func TestRunPreview(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	serverConfig := `
+mutation:
+  annotationDomain: example.com
+policy:
+  allowedKeys: ["topology.kubernetes.io/zone"]
+`
+	if err := os.WriteFile(configFile, []byte(serverConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		manifests []string
+		// lines expected on stdout and stderr
+		stdout     []string
+		stderr     []string
+		rejected   int
+		unresolved int
+	}{
+		{
+			name:      "inline config",
+			manifests: []string{newTestStatefulSetManifest("databases", "db", defaultAnnotationDomain, testMutationConfig)},
+			stdout:    []string{"StatefulSet databases/db", "db-0", "db-1"},
+		},
+		{
+			name:       "configmap reference",
+			manifests:  []string{newTestStatefulSetManifest("databases", "db", defaultAnnotationDomain, "configmap:zones#db")},
+			stderr:     []string{"StatefulSet databases/db is unresolved (needs cluster): The config is read from configmap:databases/zones#db"},
+			unresolved: 1,
+		},
+		{
+			name:       "namespace default",
+			manifests:  []string{newTestStatefulSetManifest("databases", "db", defaultAnnotationDomain, "")},
+			stderr:     []string{"StatefulSet databases/db is unresolved (needs cluster): No", "default config of namespace databases"},
+			unresolved: 1,
+		},
+		{
+			name:      "malformed configmap reference",
+			manifests: []string{newTestStatefulSetManifest("databases", "db", defaultAnnotationDomain, "configmap:zones")},
+			stderr:    []string{"StatefulSet databases/db would be rejected", "must be of the form"},
+			rejected:  1,
+		},
+		{
+			name:      "server policy and annotation domain",
+			args:      []string{"-config", configFile},
+			manifests: []string{newTestStatefulSetManifest("databases", "db", "example.com", `{"disktype": ["ssd"]}`)},
+			stderr:    []string{"StatefulSet databases/db would be rejected: Node label disktype is not allowed by the webhook policy"},
+			rejected:  1,
+		},
+		{
+			name:      "excluded namespace",
+			manifests: []string{newTestStatefulSetManifest("kube-system", "db", defaultAnnotationDomain, "configmap:zones#db")},
+			stderr:    []string{"StatefulSet kube-system/db is in an excluded namespace"},
+		},
+		{
+			name: "rejected and unresolved",
+			manifests: []string{
+				newTestStatefulSetManifest("databases", "db", defaultAnnotationDomain, "not json"),
+				newTestStatefulSetManifest("databases", "cache", defaultAnnotationDomain, "configmap:zones#cache"),
+				newTestStatefulSetManifest("databases", "web", defaultAnnotationDomain, testMutationConfig),
+			},
+			stdout:     []string{"StatefulSet databases/web"},
+			stderr:     []string{"StatefulSet databases/db would be rejected", "StatefulSet databases/cache is unresolved (needs cluster)"},
+			rejected:   1,
+			unresolved: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := runPreview(test.args, strings.NewReader(strings.Join(test.manifests, "---\n")), &stdout, &stderr)
+
+			for _, line := range test.stdout {
+				if !strings.Contains(stdout.String(), line) {
+					t.Errorf("Expected stdout to contain %q, got\n%s", line, stdout.String())
+				}
+			}
+			for _, line := range test.stderr {
+				if !strings.Contains(stderr.String(), line) {
+					t.Errorf("Expected stderr to contain %q, got\n%s", line, stderr.String())
+				}
+			}
+
+			if test.rejected == 0 && test.unresolved == 0 {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+
+			var previewError *PreviewError
+			if !errors.As(err, &previewError) {
+				t.Fatalf("Expected a PreviewError, got %v", err)
+			}
+			if previewError.Rejected != test.rejected || previewError.Unresolved != test.unresolved || previewError.Found != len(test.manifests) {
+				t.Errorf("Unexpected counts %+v", previewError)
+			}
+
+			expectedExitCode := previewExitCodeUnresolved
+			if test.rejected > 0 {
+				expectedExitCode = 1
+			}
+			if previewError.ExitCode() != expectedExitCode {
+				t.Errorf("Expected exit code %d, got %d", expectedExitCode, previewError.ExitCode())
+			}
+		})
+	}
+}
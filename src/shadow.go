@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// ShadowResult is the response the webhook would have given an object in
+// shadow mode, it is written to the shadow-result annotation
+type ShadowResult struct {
+	Allowed bool            `json:"allowed"`
+	Message string          `json:"message,omitempty"`
+	Patch   json.RawMessage `json:"patch,omitempty"`
+	// the placement of every ordinal of a statefulset that would be admitted
+	Placements []OrdinalPlacement `json:"placements,omitempty"`
+}
+
+// isShadowMode reports whether the mutation of an object is computed but not
+// applied, for every object or for a statefulset and its pods
+func isShadowMode(serverConfig *ServerConfig, object K8sObject, annotationKeys AnnotationKeys) bool {
+	if serverConfig.Mutation.Shadow {
+		return true
+	}
+
+	shadow, _ := strconv.ParseBool(object.GetAnnotations()[annotationKeys.Shadow])
+	return shadow
+}
+
+// getShadowAdmissionResponse admits an object in shadow mode. The response
+// the webhook would have given is logged, counted and written to the
+// shadow-result annotation of the object, which is the only change made.
+func getShadowAdmissionResponse(admission *Admission, object K8sObject, admissionResponse *admissionv1.AdmissionResponse, placements []OrdinalPlacement, annotationKeys AnnotationKeys) (*admissionv1.AdmissionResponse, error) {
+	decision := getAdmissionOutcome(admissionResponse)
+	shadowResult := ShadowResult{Allowed: admissionResponse.Allowed, Patch: admissionResponse.Patch, Placements: placements}
+	if admissionResponse.Result != nil {
+		shadowResult.Message = admissionResponse.Result.Message
+	}
+
+	admission.Logger.Info("Shadow mode, mutation not applied", "decision", decision, "message", shadowResult.Message, "patch", string(shadowResult.Patch))
+	shadowAdmissionsTotal.Inc(admission.HandlerName, decision)
+
+	shadowResultBytes, err := json.Marshal(shadowResult)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal shadow result into bytes -- possible formatting error: %v", err)
+	}
+
+	annotatedObject := object.DeepCopyObject().(K8sObject)
+	annotations := annotatedObject.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annotationKeys.ShadowResult] = string(shadowResultBytes)
+	annotatedObject.SetAnnotations(annotations)
+
+	patch, err := getJSONPatch(object, annotatedObject)
+	if err != nil {
+		return nil, err
+	}
+
+	auditAnnotations := map[string]string{"shadow": decision}
+	for key, value := range admissionResponse.AuditAnnotations {
+		auditAnnotations[key] = value
+	}
+
+	shadowResponse, err := getPatchAdmissionResponse(admission.Request, patch, auditAnnotations)
+	if err != nil {
+		return nil, err
+	}
+	shadowResponse.Warnings = admissionResponse.Warnings
+	if !admissionResponse.Allowed {
+		shadowResponse.Warnings = append(shadowResponse.Warnings, fmt.Sprintf("Shadow mode, the webhook would have denied this request: %s", shadowResult.Message))
+	}
+	return shadowResponse, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// StatefulSetMutator validates the config of statefulsets and records its
+// hash, so that pods are recreated when it changes
+type StatefulSetMutator struct{}
+
+func (StatefulSetMutator) GroupVersionKind() schema.GroupVersionKind {
+	return appsv1.SchemeGroupVersion.WithKind("StatefulSet")
+}
+
+func (StatefulSetMutator) HandlerName() string {
+	return "mutate-statefulsets"
+}
+
+func (StatefulSetMutator) Decode(admissionRequest *admissionv1.AdmissionRequest) (K8sObject, error) {
+	return getStatefulSetFromAdmissionRequest(admissionRequest)
+}
+
+func (StatefulSetMutator) Mutate(ctx context.Context, admission *Admission, object K8sObject) (*admissionv1.AdmissionResponse, error) {
+	serverConfig := admission.ServerConfig
+	admissionRequest := admission.Request
+	logger := admission.Logger
+	statefulSet := object.(*appsv1.StatefulSet)
+
+	recorder := eventRecorder
+	if isDryRun(admissionRequest) {
+		recorder = nil
+	}
+	statefulSetReference := getObjectReference(statefulSet, "apps/v1", "StatefulSet")
+
+	annotationKeys := getAnnotationKeys(serverConfig.Mutation.AnnotationDomain)
+	// statefulsets in shadow mode are neither denied nor changed, what the
+	// webhook would have done is only recorded
+	shadow := isShadowMode(serverConfig, statefulSet, annotationKeys)
+	configCtx, span := startSpan(ctx, "resolve config")
+	mutationConfig, err := getMutationConfig(configCtx, statefulSet, annotationKeys)
+	span.RecordError(err)
+	span.End()
+	// the request may have been given up on while the config was looked up,
+	// nothing is logged, counted or recorded for it then
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		logger.Warn("Could not get mutation config", "error", err)
+		configErrorsTotal.Inc(admission.HandlerName, admissionRequest.Namespace)
+		recorder.Eventf(statefulSetReference, corev1.EventTypeWarning, eventReasonInvalidConfig, "Invalid affinity injector config: %v", err)
+		admissionResponse := getConfigErrorAdmissionResponse(admissionRequest, err, serverConfig.Mutation.ConfigErrorPolicy)
+		if shadow {
+			return getShadowAdmissionResponse(admission, statefulSet, admissionResponse, nil, annotationKeys)
+		}
+		return admissionResponse, nil
+	}
+
+	if err := checkMutationPolicy(admissionRequest.Namespace, mutationConfig, &serverConfig.Policy); err != nil {
+		logger.Warn("Mutation config violates the webhook policy", "error", err)
+		recorder.Eventf(statefulSetReference, corev1.EventTypeWarning, eventReasonPolicyViolation, "Affinity injector config violates the webhook policy: %v", err)
+		admissionResponse := getDeniedAdmissionResponse(admissionRequest, err)
+		if shadow {
+			return getShadowAdmissionResponse(admission, statefulSet, admissionResponse, nil, annotationKeys)
+		}
+		return admissionResponse, nil
+	}
+
+	_, span = startSpan(ctx, "generate patch")
+	statefulSetPatch, err := getStatefulSetPatch(statefulSet, mutationConfig, annotationKeys)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	_, span = startSpan(ctx, "verify patch")
+	err = verifyStatefulSetPatch(admissionRequest, statefulSetPatch, mutationConfig, annotationKeys)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	auditAnnotations, err := getMutationAuditAnnotations(statefulSet, mutationConfig, annotationKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	admissionResponse, err := getPatchAdmissionResponse(admissionRequest, statefulSetPatch, auditAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	// the template patch is only recorded in the shadow result, so the pods
+	// are not rolled out and never reach the pod mutator. The placement each
+	// ordinal would get is recorded with it instead.
+	if shadow {
+		mutatedStatefulSet := statefulSet.DeepCopy()
+		if err := injectStatefulSetAnnotations(mutatedStatefulSet, mutationConfig, annotationKeys); err != nil {
+			return nil, err
+		}
+
+		placementCtx, span := startSpan(ctx, "compute placements")
+		placements, err := getStatefulSetPlacements(placementCtx, mutatedStatefulSet, getStatefulSetReplicas(statefulSet), annotationKeys)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+		return getShadowAdmissionResponse(admission, statefulSet, admissionResponse, placements, annotationKeys)
+	}
+	return admissionResponse, nil
+}
+
+// verifyStatefulSetPatch checks that the patched statefulset creates pods
+// the webhook mutates with the config hash of the statefulset
+func verifyStatefulSetPatch(admissionRequest *admissionv1.AdmissionRequest, patch []map[string]interface{}, mutationConfig map[string][]string, annotationKeys AnnotationKeys) error {
+	patchedObject, err := applyPatch(StatefulSetMutator{}, admissionRequest, patch)
+	if err != nil {
+		return err
+	}
+	templateAnnotations := patchedObject.(*appsv1.StatefulSet).Spec.Template.Annotations
+
+	if templateAnnotations[annotationKeys.Enabled] != "true" {
+		return &PatchVerificationError{Err: fmt.Errorf("Patched statefulset template does not have the %s annotation", annotationKeys.Enabled)}
+	}
+
+	mutationConfigHash, err := getMutationConfigHash(mutationConfig)
+	if err != nil {
+		return err
+	}
+	if templateAnnotations[annotationKeys.ConfigHash] != mutationConfigHash {
+		return &PatchVerificationError{Err: fmt.Errorf("Patched statefulset template has config hash %q, expected %q", templateAnnotations[annotationKeys.ConfigHash], mutationConfigHash)}
+	}
+
+	// the pods are mutated with the config on the template
+	templateMutationConfig, err := parseMutationConfig(templateAnnotations[annotationKeys.Config])
+	if err != nil {
+		return &PatchVerificationError{Err: fmt.Errorf("Patched statefulset template has an invalid config: %v", err)}
+	}
+	if templateMutationConfigHash, err := getMutationConfigHash(templateMutationConfig); err != nil || templateMutationConfigHash != mutationConfigHash {
+		return &PatchVerificationError{Err: fmt.Errorf("Patched statefulset template has a config with hash %q, expected %q", templateMutationConfigHash, mutationConfigHash)}
+	}
+	return nil
+}
+
+// OrdinalPlacement is the placement of one ordinal of a statefulset
+type OrdinalPlacement struct {
+	Ordinal   int               `json:"ordinal"`
+	Pod       string            `json:"pod"`
+	Placement map[string]string `json:"placement"`
+}
+
+// getStatefulSetReplicas returns the number of ordinals of a statefulset,
+// the api server defaults unset replicas to 1
+func getStatefulSetReplicas(statefulSet *appsv1.StatefulSet) int {
+	if statefulSet.Spec.Replicas == nil {
+		return 1
+	}
+	return int(*statefulSet.Spec.Replicas)
+}
+
+// getStatefulSetPod returns the pod the statefulset controller creates for an
+// ordinal, as far as the webhook is concerned
+func getStatefulSetPod(statefulSet *appsv1.StatefulSet, ordinal int) *corev1.Pod {
+	template := statefulSet.Spec.Template.DeepCopy()
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	pod.Name = statefulSet.Name + "-" + strconv.Itoa(ordinal)
+	pod.Namespace = statefulSet.Namespace
+
+	isController := true
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "StatefulSet",
+		Name:       statefulSet.Name,
+		UID:        statefulSet.UID,
+		Controller: &isController,
+	}}
+	return pod
+}
+
+// getStatefulSetPlacements runs the pods of the ordinals of a statefulset,
+// whose template the webhook already patched, through the same steps as the
+// pod mutator and returns where each ordinal is pinned
+func getStatefulSetPlacements(ctx context.Context, statefulSet *appsv1.StatefulSet, replicas int, annotationKeys AnnotationKeys) ([]OrdinalPlacement, error) {
+	placements := make([]OrdinalPlacement, 0, replicas)
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		pod := getStatefulSetPod(statefulSet, ordinal)
+		podMutationConfig, err := getMutationConfig(ctx, pod, annotationKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		podPatch, err := getPodPatch(pod, podMutationConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		podPlacement, err := getPodPlacement(pod, podMutationConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		podBytes, err := json.Marshal(pod)
+		if err != nil {
+			return nil, err
+		}
+		admissionRequest := &admissionv1.AdmissionRequest{
+			Resource: metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		}
+		admissionRequest.Object.Raw = podBytes
+		if err := verifyPodPatch(admissionRequest, podPatch, podPlacement); err != nil {
+			return nil, fmt.Errorf("Ordinal %d: %v", ordinal, err)
+		}
+
+		placements = append(placements, OrdinalPlacement{Ordinal: ordinal, Pod: pod.Name, Placement: podPlacement})
+	}
+	return placements, nil
+}
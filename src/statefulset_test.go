@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestStatefulSetPatchApplies(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	configHash, err := getMutationConfigHash(map[string][]string{testZoneKey: {"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(statefulSet *appsv1.StatefulSet)
+		// expected changes to the statefulset besides the template annotations
+		expect func(statefulSet *appsv1.StatefulSet)
+	}{
+		{
+			name: "new statefulset",
+		},
+		{
+			name: "label opt-in",
+			modify: func(statefulSet *appsv1.StatefulSet) {
+				statefulSet.Labels = map[string]string{annotationKeys.Enabled: "true"}
+			},
+			expect: func(statefulSet *appsv1.StatefulSet) {
+				statefulSet.Spec.Template.Labels[annotationKeys.Enabled] = "true"
+			},
+		},
+		{
+			name: "label opt-in without the annotation",
+			modify: func(statefulSet *appsv1.StatefulSet) {
+				delete(statefulSet.Annotations, annotationKeys.Enabled)
+				statefulSet.Labels = map[string]string{annotationKeys.Enabled: "True"}
+			},
+			expect: func(statefulSet *appsv1.StatefulSet) {
+				statefulSet.Spec.Template.Labels[annotationKeys.Enabled] = "true"
+			},
+		},
+		{
+			name: "label set to false",
+			modify: func(statefulSet *appsv1.StatefulSet) {
+				statefulSet.Labels = map[string]string{annotationKeys.Enabled: "false"}
+			},
+		},
+		{
+			name: "stale template annotations and shadow result",
+			modify: func(statefulSet *appsv1.StatefulSet) {
+				statefulSet.Annotations[annotationKeys.ShadowResult] = `{"allowed":false}`
+				statefulSet.Spec.Template.Annotations = map[string]string{
+					annotationKeys.Config:     `{"old": ["x"]}`,
+					annotationKeys.ConfigHash: "0000000000000000",
+					annotationKeys.Shadow:     "true",
+					"other":                   "kept",
+				}
+			},
+			expect: func(statefulSet *appsv1.StatefulSet) {
+				delete(statefulSet.Annotations, annotationKeys.ShadowResult)
+				delete(statefulSet.Spec.Template.Annotations, annotationKeys.Shadow)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statefulSet := newTestEnabledStatefulSet()
+			if test.modify != nil {
+				test.modify(statefulSet)
+			}
+
+			admissionResponse, patchedStatefulSet := mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, statefulSet))
+			if !admissionResponse.Allowed || len(admissionResponse.Patch) == 0 {
+				t.Errorf("Expected the statefulset to be patched, got %+v", admissionResponse)
+			}
+
+			expected := statefulSet.DeepCopy()
+			if expected.Spec.Template.Annotations == nil {
+				expected.Spec.Template.Annotations = map[string]string{}
+			}
+			expected.Spec.Template.Annotations[annotationKeys.Enabled] = "true"
+			// the template gets the resolved config, not the annotation
+			expected.Spec.Template.Annotations[annotationKeys.Config] = `{"topology.kubernetes.io/zone":["a","b"]}`
+			expected.Spec.Template.Annotations[annotationKeys.ConfigHash] = configHash
+			if test.expect != nil {
+				test.expect(expected)
+			}
+			assertJSONEqual(t, patchedStatefulSet, expected)
+		})
+	}
+}
+
+func TestIsMutationEnabled(t *testing.T) {
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		expected    bool
+	}{
+		{name: "annotation", annotations: map[string]string{annotationKeys.Enabled: "true"}, expected: true},
+		{name: "label", labels: map[string]string{annotationKeys.Enabled: "true"}, expected: true},
+		{name: "label parsed as bool", labels: map[string]string{annotationKeys.Enabled: "1"}, expected: true},
+		{name: "label enables despite the annotation", annotations: map[string]string{annotationKeys.Enabled: "false"}, labels: map[string]string{annotationKeys.Enabled: "true"}, expected: true},
+		{name: "annotation enables despite the label", annotations: map[string]string{annotationKeys.Enabled: "true"}, labels: map[string]string{annotationKeys.Enabled: "false"}, expected: true},
+		{name: "neither"},
+		{name: "both false", annotations: map[string]string{annotationKeys.Enabled: "false"}, labels: map[string]string{annotationKeys.Enabled: "false"}},
+		{name: "not a bool", labels: map[string]string{annotationKeys.Enabled: "yes"}},
+		{name: "other annotation domain", labels: map[string]string{getAnnotationKeys("example.com").Enabled: "true"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statefulSet := newTestStatefulSet(test.annotations)
+			statefulSet.Labels = test.labels
+			if enabled := isMutationEnabled(statefulSet, annotationKeys); enabled != test.expected {
+				t.Errorf("Expected isMutationEnabled to be %v, got %v", test.expected, enabled)
+			}
+		})
+	}
+}
+
+func TestVerifyStatefulSetPatchRejectsCorruptedPatches(t *testing.T) {
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	statefulSet := newTestEnabledStatefulSet()
+	admissionRequest := newTestStatefulSetAdmissionRequest(t, statefulSet)
+	mutationConfig := map[string][]string{testZoneKey: {"a", "b"}}
+
+	tests := []struct {
+		name    string
+		corrupt func(patch []map[string]interface{}) []map[string]interface{}
+		message string
+	}{
+		{
+			name: "wrong config hash",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "replace", "path": "/spec/template/metadata/annotations/" + escapeJSONPointer(annotationKeys.ConfigHash), "value": "0000000000000000"})
+			},
+			message: `config hash "0000000000000000"`,
+		},
+		{
+			name: "opt-in not copied",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "remove", "path": "/spec/template/metadata/annotations/" + escapeJSONPointer(annotationKeys.Enabled)})
+			},
+			message: "does not have the " + annotationKeys.Enabled + " annotation",
+		},
+		{
+			name: "unescaped annotation key",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "remove", "path": "/spec/template/metadata/annotations/" + annotationKeys.Enabled})
+			},
+			message: "does not exist",
+		},
+		{
+			name: "undecodable object",
+			corrupt: func(patch []map[string]interface{}) []map[string]interface{} {
+				return append(patch, map[string]interface{}{"op": "replace", "path": "/spec/replicas", "value": "three"})
+			},
+			message: "Could not decode patched object",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := getStatefulSetPatch(statefulSet, mutationConfig, annotationKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyStatefulSetPatch(admissionRequest, patch, mutationConfig, annotationKeys); err != nil {
+				t.Fatalf("The generated patch does not verify: %v", err)
+			}
+
+			err = verifyStatefulSetPatch(admissionRequest, test.corrupt(patch), mutationConfig, annotationKeys)
+			var patchVerificationError *PatchVerificationError
+			if !errors.As(err, &patchVerificationError) {
+				t.Fatalf("Expected a PatchVerificationError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.message) {
+				t.Errorf("Expected an error containing %q, got %q", test.message, err.Error())
+			}
+		})
+	}
+}
+
+func TestShadowStatefulSetGetsNoTemplatePatch(t *testing.T) {
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+
+	tests := []struct {
+		name         string
+		globalShadow bool
+		annotations  map[string]string
+	}{
+		{
+			name:        "shadow annotation",
+			annotations: map[string]string{annotationKeys.Shadow: "true"},
+		},
+		{
+			name:         "shadow server config",
+			globalShadow: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverConfig := defaultServerConfig()
+			serverConfig.Mutation.Shadow = test.globalShadow
+			useServerConfig(t, serverConfig)
+
+			statefulSet := newTestEnabledStatefulSet()
+			for key, value := range test.annotations {
+				statefulSet.Annotations[key] = value
+			}
+
+			admissionResponse, patchedStatefulSet := mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, statefulSet))
+			if !admissionResponse.Allowed {
+				t.Fatalf("Expected the statefulset to be admitted, got %+v", admissionResponse)
+			}
+
+			var patch []map[string]interface{}
+			json.Unmarshal(admissionResponse.Patch, &patch)
+			if len(patch) != 1 || patch[0]["path"] != "/metadata/annotations/"+escapeJSONPointer(annotationKeys.ShadowResult) {
+				t.Errorf("Expected only the shadow result to be patched, got %s", admissionResponse.Patch)
+			}
+
+			// the template is untouched, the patch it would have gotten is
+			// recorded
+			var shadowResult ShadowResult
+			if err := json.Unmarshal([]byte(patchedStatefulSet.GetAnnotations()[annotationKeys.ShadowResult]), &shadowResult); err != nil {
+				t.Fatalf("Could not decode the shadow result: %v", err)
+			}
+			if !shadowResult.Allowed || !strings.Contains(string(shadowResult.Patch), "/spec/template/metadata/annotations") {
+				t.Errorf("Expected the shadow result to record the template patch, got %+v", shadowResult)
+			}
+
+			// the pods are not mutated in shadow mode, so where they would
+			// have been pinned is recorded on the statefulset
+			expectedPlacements := []OrdinalPlacement{
+				{Ordinal: 0, Pod: "web-0", Placement: map[string]string{testZoneKey: "a"}},
+				{Ordinal: 1, Pod: "web-1", Placement: map[string]string{testZoneKey: "b"}},
+				{Ordinal: 2, Pod: "web-2", Placement: map[string]string{testZoneKey: "a"}},
+			}
+			assertJSONEqual(t, shadowResult.Placements, expectedPlacements)
+
+			// the audit log shows the decision that was not applied
+			configHash, err := getMutationConfigHash(map[string][]string{testZoneKey: {"a", "b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, admissionResponse.AuditAnnotations, map[string]string{"shadow": "mutated", "config-source": "annotation", "config-hash": configHash})
+
+			expected := statefulSet.DeepCopy()
+			expected.Annotations[annotationKeys.ShadowResult] = patchedStatefulSet.GetAnnotations()[annotationKeys.ShadowResult]
+			assertJSONEqual(t, patchedStatefulSet, expected)
+		})
+	}
+}
+
+func TestShadowStatefulSetWithInvalidConfigIsAdmitted(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	statefulSet := newTestStatefulSet(map[string]string{
+		annotationKeys.Enabled: "true",
+		annotationKeys.Shadow:  "true",
+		annotationKeys.Config:  "not json",
+	})
+
+	admissionResponse, patchedStatefulSet := mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, statefulSet))
+	if !admissionResponse.Allowed || len(admissionResponse.Warnings) != 1 || !strings.Contains(admissionResponse.Warnings[0], "the webhook would have denied this request") {
+		t.Errorf("Expected the statefulset to be admitted with a warning, got %+v", admissionResponse)
+	}
+	assertJSONEqual(t, admissionResponse.AuditAnnotations, map[string]string{"shadow": "denied"})
+
+	var shadowResult ShadowResult
+	if err := json.Unmarshal([]byte(patchedStatefulSet.GetAnnotations()[annotationKeys.ShadowResult]), &shadowResult); err != nil {
+		t.Fatalf("Could not decode the shadow result: %v", err)
+	}
+	if shadowResult.Allowed || !strings.Contains(shadowResult.Message, "Error parsing") || len(shadowResult.Placements) != 0 {
+		t.Errorf("Expected the shadow result to record the denial, got %+v", shadowResult)
+	}
+}
+
+func TestStatefulSetConfigMapReferenceIsSnapshotted(t *testing.T) {
+	useServerConfig(t, defaultServerConfig())
+	annotationKeys := getAnnotationKeys(defaultAnnotationDomain)
+	useConfigMapInformers(t, map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{
+		"": newTestConfigMapInformer(newTestConfigMap("db", "placement", map[string]string{"web": testMutationConfig})),
+	})
+
+	statefulSet := newTestStatefulSet(map[string]string{
+		annotationKeys.Enabled: "true",
+		annotationKeys.Config:  "configmap:placement#web",
+	})
+	admissionResponse, patchedStatefulSet := mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, statefulSet))
+	if !admissionResponse.Allowed {
+		t.Fatalf("Expected the statefulset to be admitted, got %+v", admissionResponse)
+	}
+	if source := admissionResponse.AuditAnnotations["config-source"]; source != "configmap:db/placement#web" {
+		t.Errorf("Expected the configmap as config source, got %q", source)
+	}
+	templateAnnotations := patchedStatefulSet.(*appsv1.StatefulSet).Spec.Template.Annotations
+	if config := templateAnnotations[annotationKeys.Config]; config != `{"topology.kubernetes.io/zone":["a","b"]}` {
+		t.Errorf("Expected the resolved config on the template, got %q", config)
+	}
+	configHash := templateAnnotations[annotationKeys.ConfigHash]
+
+	// editing the configmap changes neither the template nor new pods
+	useConfigMapInformers(t, map[string]*Informer[corev1.ConfigMap, *corev1.ConfigMap]{
+		"": newTestConfigMapInformer(newTestConfigMap("db", "placement", map[string]string{"web": `{"topology.kubernetes.io/zone": ["c"]}`})),
+	})
+	pod := getStatefulSetPod(patchedStatefulSet.(*appsv1.StatefulSet), 1)
+	admissionResponse, _ = mutateAndApply(t, PodMutator{}, newTestPodAdmissionRequest(t, pod))
+	if placement := admissionResponse.AuditAnnotations["placement"]; placement != testZoneKey+"=b" {
+		t.Errorf("Expected the pod to keep the placement of its template, got %q", placement)
+	}
+	if source := admissionResponse.AuditAnnotations["config-source"]; source != "statefulset" {
+		t.Errorf("Expected the statefulset as config source, got %q", source)
+	}
+
+	// applying the statefulset again picks up the change and rolls it out
+	_, reappliedStatefulSet := mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, patchedStatefulSet.(*appsv1.StatefulSet)))
+	templateAnnotations = reappliedStatefulSet.(*appsv1.StatefulSet).Spec.Template.Annotations
+	if templateAnnotations[annotationKeys.Config] != `{"topology.kubernetes.io/zone":["c"]}` || templateAnnotations[annotationKeys.ConfigHash] == configHash {
+		t.Errorf("Expected the new config and hash on the template, got %v", templateAnnotations)
+	}
+
+	// a missing configmap is a config error
+	statefulSet.Annotations[annotationKeys.Config] = "configmap:missing#web"
+	admissionResponse, _ = mutateAndApply(t, StatefulSetMutator{}, newTestStatefulSetAdmissionRequest(t, statefulSet))
+	if admissionResponse.Allowed || admissionResponse.Result == nil || !strings.Contains(admissionResponse.Result.Message, "ConfigMap db/missing referenced by \"configmap:missing#web\" does not exist") {
+		t.Errorf("Expected the statefulset to be denied, got %+v", admissionResponse)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	tlsVersion12 = "1.2"
+	tlsVersion13 = "1.3"
+)
+
+const (
+	// expiry warnings are logged at most this often
+	certificateExpiryWarningInterval = time.Hour
+	certificateWaitRetryInterval     = 5 * time.Second
+)
+
+// CertificateReloader serves a certificate and reloads it when it changes,
+// so rotated Secrets are picked up without a restart. The certificate is read
+// from files, or from a Secret for self managed certificates.
+type CertificateReloader struct {
+	// describes where the certificate is read from in logs
+	source        string
+	read          func() ([]byte, []byte, error)
+	warningPeriod time.Duration
+
+	certificate atomic.Pointer[tls.Certificate]
+
+	// only used by load and Run
+	lastCertBytes     []byte
+	lastKeyBytes      []byte
+	lastExpiryWarning time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string, warningDays int) *CertificateReloader {
+	return &CertificateReloader{
+		source: certFile,
+		read: func() ([]byte, []byte, error) {
+			certBytes, err := os.ReadFile(certFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not read certificate file %s: %v", certFile, err)
+			}
+
+			keyBytes, err := os.ReadFile(keyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not read key file %s: %v", keyFile, err)
+			}
+
+			return certBytes, keyBytes, nil
+		},
+		warningPeriod: days(warningDays),
+	}
+}
+
+func NewSecretCertificateReloader(client *KubeClient, namespace string, secretName string, warningDays int) *CertificateReloader {
+	secretPath := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, secretName)
+	return &CertificateReloader{
+		source: "secret " + namespace + "/" + secretName,
+		read: func() ([]byte, []byte, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), configPollInterval)
+			defer cancel()
+
+			var secret corev1.Secret
+			if err := client.Get(ctx, secretPath, &secret); err != nil {
+				return nil, nil, fmt.Errorf("Could not get certificate secret %s/%s: %v", namespace, secretName, err)
+			}
+
+			return secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], nil
+		},
+		warningPeriod: days(warningDays),
+	}
+}
+
+// load reads the certificate and key and reports whether a new certificate
+// is served. A certificate that fails to load is not retried until its
+// content changes again.
+func (c *CertificateReloader) load() (bool, error) {
+	certBytes, keyBytes, err := c.read()
+	if err != nil {
+		return false, err
+	}
+
+	if bytes.Equal(certBytes, c.lastCertBytes) && bytes.Equal(keyBytes, c.lastKeyBytes) {
+		return false, nil
+	}
+	c.lastCertBytes, c.lastKeyBytes = certBytes, keyBytes
+
+	// the leaf is parsed by X509KeyPair, it is the serving certificate in a chain
+	certificate, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return false, fmt.Errorf("Could not load certificate from %s: %v", c.source, err)
+	}
+
+	c.certificate.Store(&certificate)
+	c.lastExpiryWarning = time.Time{}
+	tlsCertificateExpiry.Set(float64(certificate.Leaf.NotAfter.Unix()))
+	return true, nil
+}
+
+// waitForCertificate loads the certificate, retrying until it can be loaded
+// or timeout passes. Self managed certificates may not have been generated
+// by the leader yet.
+func (c *CertificateReloader) waitForCertificate(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(certificateWaitRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := c.load()
+		if err == nil {
+			return nil
+		}
+
+		slog.Info("Waiting for serving certificate", "source", c.source, "error", err)
+		// a certificate that failed to load is retried even if it did not change
+		c.lastCertBytes, c.lastKeyBytes = nil, nil
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Timed out waiting for serving certificate: %v", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate.Load(), nil
+}
+
+func (c *CertificateReloader) getExpiry() time.Time {
+	return c.certificate.Load().Leaf.NotAfter
+}
+
+func (c *CertificateReloader) checkExpiry() {
+	if time.Since(c.lastExpiryWarning) < certificateExpiryWarningInterval {
+		return
+	}
+
+	expiry := c.getExpiry()
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		slog.Error("Serving certificate has expired", "source", c.source, "expiry", expiry)
+	} else if remaining < c.warningPeriod {
+		slog.Warn("Serving certificate expires soon", "source", c.source, "expiry", expiry, "remaining", remaining.Round(time.Minute).String())
+	} else {
+		return
+	}
+	c.lastExpiryWarning = time.Now()
+}
+
+// Run polls the certificate until ctx is cancelled. The content of files is
+// compared instead of the modification time since mounted Secrets are updated
+// by swapping a symlink.
+func (c *CertificateReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	c.checkExpiry()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.load()
+			if err != nil {
+				slog.Warn("Could not reload serving certificate, keeping the old one", "error", err)
+				certificateReloadsTotal.Inc("failure")
+			} else if reloaded {
+				slog.Info("Reloaded serving certificate", "source", c.source, "expiry", c.getExpiry())
+				certificateReloadsTotal.Inc("success")
+			}
+
+			c.checkExpiry()
+		}
+	}
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case tlsVersion12:
+		return tls.VersionTLS12, nil
+	case tlsVersion13:
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("server.tlsMinVersion must be %s or %s, got %q", tlsVersion12, tlsVersion13, version)
+	}
+}
+
+// parseCipherSuites looks up cipher suites by their IANA names, e.g.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Insecure suites are rejected, and
+// TLS 1.3 suites are not configurable in go.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		index := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool {
+			return suite.Name == name
+		})
+		if index < 0 {
+			return nil, fmt.Errorf("server.tlsCipherSuites contains unknown or insecure cipher suite %q", name)
+		}
+
+		suite := tls.CipherSuites()[index]
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("server.tlsCipherSuites contains TLS 1.3 cipher suite %q, which can not be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// newServerTLSConfig serves the certificate of the reloader and, with a
+// client CA file, requires client certificates signed by it. The client CA
+// file is only read at startup.
+func newServerTLSConfig(options *ServerOptions, certificateReloader *CertificateReloader) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(options.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(options.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certificateReloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+	if options.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caBytes, err := os.ReadFile(options.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read client CA file %s: %v", options.ClientCAFile, err)
+	}
+
+	cas, err := parseCertificatesPEM(caBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load client CA file %s: %v", options.ClientCAFile, err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	for _, ca := range cas {
+		clientCAs.AddCert(ca)
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = clientCAs
+	if len(options.AllowedClientNames) > 0 {
+		allowedClientNames := options.AllowedClientNames
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyClientName(state.PeerCertificates[0], allowedClientNames)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyClientName checks that the common name or one of the dns names of a
+// verified client certificate is allowed, the error is logged by the server
+// as a tls handshake error
+func verifyClientName(certificate *x509.Certificate, allowedClientNames []string) error {
+	names := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+	for _, name := range names {
+		if name != "" && slices.Contains(allowedClientNames, name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate with common name %q and dns names %v is not allowed", certificate.Subject.CommonName, certificate.DNSNames)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificateAuthority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func newTestCertificateAuthority(t *testing.T) *testCertificateAuthority {
+	t.Helper()
+	key, err := generatePrivateKey(keyTypeECDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := generateCertificateAuthority("test-ca", time.Hour, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificateAuthority{certificate: certificate, key: key}
+}
+
+// newClientCertificate signs a client certificate with the common name and
+// dns names
+func (ca *testCertificateAuthority) newClientCertificate(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	key, err := generatePrivateKey(keyTypeECDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := signCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, key, ca.certificate, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key, Leaf: certificate}
+}
+
+// startTestTLSServer serves https with the tls config of the server options,
+// using a serving certificate for localhost signed by ca
+func startTestTLSServer(t *testing.T, ca *testCertificateAuthority, options *ServerOptions) *httptest.Server {
+	t.Helper()
+	key, err := generatePrivateKey(keyTypeECDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := generateServingCertificate(ca.certificate, ca.key, []string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Hour, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	options.CertFile = filepath.Join(directory, "tls.crt")
+	options.KeyFile = filepath.Join(directory, "tls.key")
+	os.WriteFile(options.CertFile, encodeCertificatePEM(certificate), 0o600)
+	os.WriteFile(options.KeyFile, keyPEM, 0o600)
+
+	certificateReloader := NewCertificateReloader(options.CertFile, options.KeyFile, 0)
+	if _, err := certificateReloader.load(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := newServerTLSConfig(options, certificateReloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleStatus))
+	server.TLS = tlsConfig
+	// rejected handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServerTLSConfigVerifiesClientNames(t *testing.T) {
+	ca := newTestCertificateAuthority(t)
+	otherCA := newTestCertificateAuthority(t)
+
+	clientCAFile := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(clientCAFile, encodeCertificatePEM(ca.certificate), 0o600)
+
+	tests := []struct {
+		name               string
+		allowedClientNames []string
+		// no client certificate is sent if nil
+		clientCA *testCertificateAuthority
+		// the common name and dns names of the client certificate
+		clientNames    []string
+		expectAccepted bool
+	}{
+		{
+			name:               "allowed common name",
+			allowedClientNames: []string{"kube-apiserver"},
+			clientCA:           ca,
+			clientNames:        []string{"kube-apiserver"},
+			expectAccepted:     true,
+		},
+		{
+			name:               "allowed dns name",
+			allowedClientNames: []string{"apiserver.example.com"},
+			clientCA:           ca,
+			clientNames:        []string{"kube-apiserver", "apiserver.example.com"},
+			expectAccepted:     true,
+		},
+		{
+			name:               "wrong name",
+			allowedClientNames: []string{"kube-apiserver"},
+			clientCA:           ca,
+			clientNames:        []string{"intruder", "intruder.example.com"},
+		},
+		{
+			name:               "allowed name signed by another ca",
+			allowedClientNames: []string{"kube-apiserver"},
+			clientCA:           otherCA,
+			clientNames:        []string{"kube-apiserver"},
+		},
+		{
+			name:               "no client certificate",
+			allowedClientNames: []string{"kube-apiserver"},
+		},
+		{
+			name:           "any name without allowed names",
+			clientCA:       ca,
+			clientNames:    []string{"intruder"},
+			expectAccepted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := defaultServerConfig().Server
+			options.ClientCAFile = clientCAFile
+			options.AllowedClientNames = test.allowedClientNames
+			server := startTestTLSServer(t, ca, &options)
+
+			rootCAs := x509.NewCertPool()
+			rootCAs.AddCert(ca.certificate)
+			clientTLSConfig := &tls.Config{RootCAs: rootCAs, ServerName: "localhost"}
+			if test.clientCA != nil {
+				clientTLSConfig.Certificates = []tls.Certificate{test.clientCA.newClientCertificate(t, test.clientNames[0], test.clientNames[1:]...)}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig}}
+
+			response, err := client.Get(server.URL + "/status")
+			if err == nil {
+				response.Body.Close()
+			}
+			if test.expectAccepted && (err != nil || response.StatusCode != http.StatusOK) {
+				t.Errorf("Expected the client to be accepted, got %v", err)
+			}
+			if !test.expectAccepted && err == nil {
+				t.Errorf("Expected the client to be rejected, got status %d", response.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const (
+	tracingScopeName     = "statefulset-affinity-injector"
+	tracingQueueSize     = 2048
+	tracingMaxBatchSize  = 512
+	tracingExportTimeout = 10 * time.Second
+
+	// otlp span kinds and status codes
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+type TracingOptions struct {
+	Enabled bool `json:"enabled"`
+	// base url of an otlp/http collector, spans are posted to /v1/traces
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"serviceName"`
+	// fraction of requests that are traced when the api server did not send
+	// a sampled traceparent header
+	SamplingRatio         float64 `json:"samplingRatio"`
+	ExportIntervalSeconds int     `json:"exportIntervalSeconds"`
+}
+
+func (o *TracingOptions) validate() error {
+	if !o.Enabled {
+		return nil
+	}
+
+	endpoint, err := url.Parse(o.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("tracing.endpoint must be an http or https url, got %q", o.Endpoint)
+	}
+
+	if o.ServiceName == "" {
+		return fmt.Errorf("tracing.serviceName can not be empty")
+	}
+
+	if o.SamplingRatio < 0 || o.SamplingRatio > 1 {
+		return fmt.Errorf("tracing.samplingRatio must be between 0 and 1, got %v", o.SamplingRatio)
+	}
+
+	if o.ExportIntervalSeconds <= 0 {
+		return fmt.Errorf("tracing.exportIntervalSeconds must be positive")
+	}
+
+	return nil
+}
+
+// Span is a minimal otlp span. All methods can be called on a nil span, which
+// is what startSpan returns when tracing is disabled.
+type Span struct {
+	tracer       *Tracer
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID []byte
+	sampled      bool
+
+	name  string
+	kind  int
+	start time.Time
+
+	mutex         sync.Mutex
+	end           time.Time
+	attributes    []interface{}
+	statusCode    int
+	statusMessage string
+}
+
+type spanContextKey struct{}
+
+func getSpan(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// SetAttributes takes alternating keys and values, like slog
+func (s *Span) SetAttributes(keyValues ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, keyValues...)
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statusCode = spanStatusError
+	s.statusMessage = err.Error()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	if s.sampled {
+		s.tracer.export(s)
+	}
+}
+
+// Tracer batches finished spans and posts them to an otlp/http collector
+type Tracer struct {
+	options TracingOptions
+	client  *http.Client
+	queue   chan *Span
+	done    chan struct{}
+}
+
+// tracer is nil unless tracing is enabled
+var tracer *Tracer
+
+func NewTracer(options TracingOptions) *Tracer {
+	return &Tracer{
+		options: options,
+		client:  &http.Client{Timeout: tracingExportTimeout},
+		queue:   make(chan *Span, tracingQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parentSpanID []byte, sampled bool) *Span {
+	span := &Span{
+		tracer:       t,
+		traceID:      traceID,
+		parentSpanID: parentSpanID,
+		sampled:      sampled,
+		name:         name,
+		kind:         kind,
+		start:        time.Now(),
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// startSpan starts a child of the span in ctx, or a new trace if there is none
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	var span *Span
+	if parent := getSpan(ctx); parent != nil {
+		span = tracer.newSpan(name, spanKindInternal, parent.traceID, parent.spanID[:], parent.sampled)
+	} else {
+		var traceID [16]byte
+		rand.Read(traceID[:])
+		span = tracer.newSpan(name, spanKindInternal, traceID, nil, mathrand.Float64() < tracer.options.SamplingRatio)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// parseTraceParent parses a w3c traceparent header, which the api server
+// sends to webhooks when its own tracing is enabled
+func parseTraceParent(header string) (traceID [16]byte, spanID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, false, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, false, false
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, spanID, false, false
+	}
+
+	return traceID, spanID, flags&1 == 1, true
+}
+
+// startServerSpan starts the span of an incoming request, continuing the
+// trace of the caller if it sent a traceparent header
+func startServerSpan(r *http.Request, name string) (*http.Request, *Span) {
+	if tracer == nil {
+		return r, nil
+	}
+
+	var span *Span
+	if traceID, parentSpanID, sampled, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+		// an unsampled parent may still be sampled here, so the webhook can
+		// be traced without tracing the whole api server
+		sampled = sampled || mathrand.Float64() < tracer.options.SamplingRatio
+		span = tracer.newSpan(name, spanKindServer, traceID, parentSpanID[:], sampled)
+	} else {
+		var traceID [16]byte
+		rand.Read(traceID[:])
+		span = tracer.newSpan(name, spanKindServer, traceID, nil, mathrand.Float64() < tracer.options.SamplingRatio)
+	}
+
+	span.SetAttributes("http.request.method", r.Method, "url.path", r.URL.Path)
+	return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span)), span
+}
+
+func (t *Tracer) export(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		slog.Debug("Dropped span because the span queue is full", "span", span.name)
+	}
+}
+
+// Run exports queued spans every export interval, or as soon as a batch is
+// full, until ctx is cancelled. The spans left in the queue are exported
+// before done is closed.
+func (t *Tracer) Run(ctx context.Context) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(time.Duration(t.options.ExportIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, tracingMaxBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.post(batch); err != nil {
+			slog.Warn("Could not export spans", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) == tracingMaxBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) == tracingMaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func getOTLPValue(value interface{}) map[string]interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": typedValue}
+	case bool:
+		return map[string]interface{}{"boolValue": typedValue}
+	case int:
+		// int64 values are strings in otlp json
+		return map[string]interface{}{"intValue": strconv.Itoa(typedValue)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(typedValue, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": typedValue}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(typedValue)}
+	}
+}
+
+func getOTLPAttributes(keyValues []interface{}) []map[string]interface{} {
+	attributes := make([]map[string]interface{}, 0, len(keyValues)/2)
+	for index := 0; index+1 < len(keyValues); index += 2 {
+		attributes = append(attributes, map[string]interface{}{
+			"key":   fmt.Sprint(keyValues[index]),
+			"value": getOTLPValue(keyValues[index+1]),
+		})
+	}
+	return attributes
+}
+
+func (s *Span) getOTLPSpan() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	otlpSpan := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        getOTLPAttributes(s.attributes),
+	}
+
+	if s.parentSpanID != nil {
+		otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentSpanID)
+	}
+
+	if s.statusCode != 0 {
+		otlpSpan["status"] = map[string]interface{}{"code": s.statusCode, "message": s.statusMessage}
+	}
+
+	return otlpSpan
+}
+
+// post sends spans with the json encoding of otlp/http
+func (t *Tracer) post(spans []*Span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, span.getOTLPSpan())
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": getOTLPAttributes([]interface{}{"service.name", t.options.ServiceName}),
+			},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]interface{}{"name": tracingScopeName},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not marshal spans into bytes -- possible formatting error: %v", err)
+	}
+
+	response, err := t.client.Post(strings.TrimSuffix(t.options.Endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("collector responded with %s", response.Status)
+	}
+	return nil
+}
+
+func startTracer(ctx context.Context, tracingOptions *TracingOptions) {
+	if !tracingOptions.Enabled {
+		return
+	}
+
+	tracer = NewTracer(*tracingOptions)
+	go tracer.Run(ctx)
+}
+
+// stopTracer waits for the spans left in the queue to be exported, ctx must
+// be cancelled first
+func stopTracer() {
+	if tracer == nil {
+		return
+	}
+
+	select {
+	case <-tracer.done:
+	case <-time.After(tracingExportTimeout):
+		slog.Warn("Timed out exporting the remaining spans")
+	}
+}
+
+func setAdmissionSpanAttributes(span *Span, admissionRequest *admissionv1.AdmissionRequest) {
+	span.SetAttributes(
+		"admission.uid", string(admissionRequest.UID),
+		"admission.kind", admissionRequest.Kind.Kind,
+		"admission.operation", string(admissionRequest.Operation),
+		"admission.dry_run", isDryRun(admissionRequest),
+		"k8s.namespace.name", admissionRequest.Namespace,
+	)
+}
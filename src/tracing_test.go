@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{name: "not sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{name: "other flags", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", ok: true, sampled: true},
+		{name: "empty", header: ""},
+		{name: "all zero trace id", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "all zero span id", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short trace id", header: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+		{name: "long span id", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b700-01"},
+		{name: "short flags", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"},
+		{name: "invalid version", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "unknown version", header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "version not hex", header: "0x-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "trace id not hex", header: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{name: "flags not hex", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+		{name: "missing part", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{name: "extra part", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			traceID, spanID, sampled, ok := parseTraceParent(test.header)
+			if ok != test.ok || sampled != test.sampled {
+				t.Fatalf("Expected ok %v and sampled %v, got %v and %v", test.ok, test.sampled, ok, sampled)
+			}
+			if ok && (hex.EncodeToString(traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(spanID[:]) != "00f067aa0ba902b7") {
+				t.Errorf("Unexpected trace id %x and span id %x", traceID, spanID)
+			}
+		})
+	}
+}
+
+type otlpTestAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpTestSpan struct {
+	TraceID           string              `json:"traceId"`
+	SpanID            string              `json:"spanId"`
+	ParentSpanID      string              `json:"parentSpanId"`
+	Name              string              `json:"name"`
+	Kind              int                 `json:"kind"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string              `json:"endTimeUnixNano"`
+	Attributes        []otlpTestAttribute `json:"attributes"`
+	Status            *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type otlpTestRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpTestAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []otlpTestSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTracerExport(t *testing.T) {
+	var requests []otlpTestRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export request %s %s with content type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request otlpTestRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("Could not parse exported spans %s: %v", body, err)
+		}
+		requests = append(requests, request)
+	}))
+	defer collector.Close()
+
+	tracer = NewTracer(TracingOptions{Enabled: true, Endpoint: collector.URL + "/", ServiceName: "injector", ExportIntervalSeconds: 3600})
+	defer func() { tracer = nil }()
+	ctx, cancel := context.WithCancel(context.Background())
+	go tracer.Run(ctx)
+
+	request := httptest.NewRequest("POST", "/mutate-pods", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request, serverSpan := startServerSpan(request, "admission")
+	serverSpan.SetAttributes("admission.dry_run", false, "http.response.status_code", 200)
+
+	_, childSpan := startSpan(request.Context(), "generate patch")
+	childSpan.RecordError(errors.New("invalid config"))
+	childSpan.End()
+	serverSpan.End()
+
+	cancel()
+	<-tracer.done
+
+	if len(requests) != 1 || len(requests[0].ResourceSpans) != 1 || len(requests[0].ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected one export with one resource and scope, got %+v", requests)
+	}
+	resourceSpans := requests[0].ResourceSpans[0]
+	if len(resourceSpans.Resource.Attributes) != 1 || resourceSpans.Resource.Attributes[0].Key != "service.name" || resourceSpans.Resource.Attributes[0].Value["stringValue"] != "injector" {
+		t.Errorf("Unexpected resource attributes %+v", resourceSpans.Resource.Attributes)
+	}
+	if resourceSpans.ScopeSpans[0].Scope.Name != tracingScopeName {
+		t.Errorf("Unexpected scope %q", resourceSpans.ScopeSpans[0].Scope.Name)
+	}
+
+	spans := resourceSpans.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	child, server := spans[0], spans[1]
+
+	if server.Name != "admission" || server.Kind != spanKindServer || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.Status != nil {
+		t.Errorf("Unexpected server span %+v", server)
+	}
+	if child.Name != "generate patch" || child.Kind != spanKindInternal || child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID {
+		t.Errorf("Unexpected child span %+v of %s", child, server.SpanID)
+	}
+	if child.Status == nil || child.Status.Code != spanStatusError || child.Status.Message != "invalid config" {
+		t.Errorf("Expected the child span to have an error status, got %+v", child.Status)
+	}
+	if len(server.SpanID) != 16 || len(child.SpanID) != 16 || server.SpanID == child.SpanID {
+		t.Errorf("Expected distinct span ids, got %s and %s", server.SpanID, child.SpanID)
+	}
+	if server.StartTimeUnixNano == "" || server.StartTimeUnixNano > server.EndTimeUnixNano {
+		t.Errorf("Unexpected server span times %s to %s", server.StartTimeUnixNano, server.EndTimeUnixNano)
+	}
+
+	attributes, _ := json.Marshal(server.Attributes)
+	expected := `[{"key":"http.request.method","value":{"stringValue":"POST"}},` +
+		`{"key":"url.path","value":{"stringValue":"/mutate-pods"}},` +
+		`{"key":"admission.dry_run","value":{"boolValue":false}},` +
+		`{"key":"http.response.status_code","value":{"intValue":"200"}}]`
+	if string(attributes) != expected {
+		t.Errorf("Unexpected attributes\n%s\nexpected\n%s", attributes, expected)
+	}
+}
+
+func TestUnsampledSpansAreNotExported(t *testing.T) {
+	tracer = NewTracer(TracingOptions{Enabled: true, SamplingRatio: 0})
+	defer func() { tracer = nil }()
+
+	request := httptest.NewRequest("POST", "/mutate", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	request, serverSpan := startServerSpan(request, "admission")
+	_, childSpan := startSpan(request.Context(), "decode object")
+	childSpan.End()
+	serverSpan.End()
+
+	if len(tracer.queue) != 0 {
+		t.Errorf("Expected no spans to be exported, got %d", len(tracer.queue))
+	}
+}
@@ -9,3 +9,14 @@ type K8sObject interface {
     metav1.Object
     runtime.Object
 }
+
+// AnnotationKeys are the annotations the webhook reads and writes. They all
+// share a configurable domain so that several instances can run side by side.
+// Enabled is also the key of the opt-in label.
+type AnnotationKeys struct {
+	Enabled string
+	Config string
+	ConfigHash string
+	Shadow string
+	ShadowResult string
+}
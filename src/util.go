@@ -1,21 +1,40 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strconv"
+	"sort"
 	"strings"
+	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 
 	corev1 "k8s.io/api/core/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const defaultAnnotationDomain = "statefulset-affinity-injector-webhook.hsiam261.github.io"
+
+func getAnnotationKeys(annotationDomain string) AnnotationKeys {
+	return AnnotationKeys{
+		Enabled: annotationDomain + "/enabled",
+		Config: annotationDomain + "/config",
+		ConfigHash: annotationDomain + "/config-hash",
+		Shadow: annotationDomain + "/shadow",
+		ShadowResult: annotationDomain + "/shadow-result",
+	}
+}
+
 func getAdmissionReviewFromRequest(reader io.Reader) (*admissionv1.AdmissionReview, error) {
 	var admissionReview admissionv1.AdmissionReview
 	if err := json.NewDecoder(reader).Decode(&admissionReview); err != nil {
-		newErr := fmt.Errorf("Could not decode request: %v", err.Error())
+		// wrapped so serveAdmission can tell bodies over the size limit apart
+		newErr := fmt.Errorf("Could not decode request: %w", err)
 		return nil, newErr
 	}
 
@@ -34,6 +53,11 @@ func getPodFromAdmissionRequest(admissionRequest *admissionv1.AdmissionRequest)
 		return nil, newErr
 	}
 
+	// the namespace may be unset on the object for pods that are being created
+	if pod.Namespace == "" {
+		pod.Namespace = admissionRequest.Namespace
+	}
+
 	return &pod, nil
 }
 
@@ -52,35 +76,169 @@ func getStatefulSetFromAdmissionRequest(admissionRequest *admissionv1.AdmissionR
 	return &statefulset, nil
 }
 
-func getMutationConfig(object K8sObject) (map[string][]string, error) {
+func parseMutationConfig(value string) (map[string][]string, error) {
+	var mutationConfig map[string][]string
+	if err := json.Unmarshal([]byte(value), &mutationConfig); err != nil {
+		return nil, err
+	}
+
+	for key, vals := range mutationConfig {
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("node label %s has no values", key)
+		}
+	}
+
+	return mutationConfig, nil
+}
+
+// keys set on the object take precedence over the namespace defaults
+func mergeMutationConfigs(defaults map[string][]string, overrides map[string][]string) map[string][]string {
+	merged := make(map[string][]string, len(defaults) + len(overrides))
+	for key, vals := range defaults {
+		merged[key] = vals
+	}
+
+	for key, vals := range overrides {
+		merged[key] = vals
+	}
+
+	return merged
+}
+
+// objects opt in with either the enabled annotation or a label of the same
+// name, the label allows filtering with an objectSelector on the webhook
+func isMutationEnabled(object K8sObject, annotationKeys AnnotationKeys) bool {
+	annotationEnabled, _ := strconv.ParseBool(object.GetAnnotations()[annotationKeys.Enabled])
+	labelEnabled, _ := strconv.ParseBool(object.GetLabels()[annotationKeys.Enabled])
+	return annotationEnabled || labelEnabled
+}
+
+func getMutationConfig(ctx context.Context, object K8sObject, annotationKeys AnnotationKeys) (map[string][]string, error) {
 	kind := object.GetObjectKind().GroupVersionKind().Kind
 	name := object.GetName()
 	namespace := object.GetNamespace()
 	annotations := object.GetAnnotations()
 
-	if _, ok := annotations["statefulset-affinity-injector-webhook.hsiam261.github.io/enabled"]; !ok {
-		err := fmt.Errorf("%s %s in namespace %s does not have \"statefulset-affinity-injector-webhook.hsiam261.github.io/enabled\" annotation set",kind, name, namespace)
+	if !isMutationEnabled(object, annotationKeys) {
+		err := fmt.Errorf("%s %s in namespace %s does not have \"%s\" annotation or label set to true", kind, name, namespace, annotationKeys.Enabled)
 		return nil, err
 	}
 
-	if mutationEnabled, _ := strconv.ParseBool(annotations["statefulset-affinity-injector-webhook.hsiam261.github.io/enabled"]); !mutationEnabled {
-		err := fmt.Errorf("%s %s in namespace %s does not have \"statefulset-affinity-injector-webhook.hsiam261.github.io/enabled\" annotation set to true", kind, name, namespace)
+	// the statefulset mutator snapshots the resolved config into the pod
+	// template along with its hash, so pods keep the config their statefulset
+	// was admitted with when a namespace default or configmap changes
+	if mutationConfigSnapshot, ok := getMutationConfigSnapshot(object, annotationKeys); ok {
+		mutationConfig, err := parseMutationConfig(mutationConfigSnapshot)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing \"%s\" value for %s %s in namespace %s: %v", annotationKeys.Config, kind, name, namespace, err)
+		}
+		return mutationConfig, nil
+	}
+
+	namespaceMutationConfig, err := getNamespaceMutationConfig(ctx, namespace, annotationKeys)
+	if err != nil {
 		return nil, err
 	}
 
-	mutationConfigAnnotation, ok := annotations["statefulset-affinity-injector-webhook.hsiam261.github.io/config"]
+	mutationConfigAnnotation, ok := annotations[annotationKeys.Config]
 	if !ok {
-		err := fmt.Errorf("%s %s in namespace %s does not have \"statefulset-affinity-injector-webhook.hsiam261.github.io/config\" annotation", kind, name, namespace)
-		return nil, err
+		if namespaceMutationConfig == nil {
+			err := fmt.Errorf("%s %s in namespace %s does not have \"%s\" annotation and the namespace has no default config", kind, name, namespace, annotationKeys.Config)
+			return nil, err
+		}
+
+		return namespaceMutationConfig, nil
 	}
 
-	var mutationConfig map[string][]string
-	if err := json.Unmarshal([]byte(mutationConfigAnnotation), &mutationConfig); err != nil {
-		newErr := fmt.Errorf("Error parsing \"statefulset-affinity-injector-webhook.hsiam261.github.io/config\" value for kind %s in namespace %s: %v", kind, name, namespace, err)
+	mutationConfigValue, err := resolveMutationConfigValue(ctx, mutationConfigAnnotation, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve \"%s\" value for %s %s in namespace %s: %v", annotationKeys.Config, kind, name, namespace, err)
+	}
+
+	mutationConfig, err := parseMutationConfig(mutationConfigValue)
+	if err != nil {
+		newErr := fmt.Errorf("Error parsing \"%s\" value for %s %s in namespace %s: %v", annotationKeys.Config, kind, name, namespace, err)
 		return nil, newErr
 	}
 
-	return mutationConfig, nil
+	return mergeMutationConfigs(namespaceMutationConfig, mutationConfig), nil
+}
+
+// getMutationConfigSnapshot returns the config the statefulset mutator
+// resolved for a pod template, which is marked by the config hash
+func getMutationConfigSnapshot(object K8sObject, annotationKeys AnnotationKeys) (string, bool) {
+	annotations := object.GetAnnotations()
+	if _, ok := annotations[annotationKeys.ConfigHash]; !ok {
+		return "", false
+	}
+	mutationConfigSnapshot, ok := annotations[annotationKeys.Config]
+	return mutationConfigSnapshot, ok
+}
+
+// getMutationConfigSource describes where the config returned by
+// getMutationConfig comes from, the namespace default is listed first since
+// the object config is merged over it
+func getMutationConfigSource(object K8sObject, annotationKeys AnnotationKeys) string {
+	if _, ok := getMutationConfigSnapshot(object, annotationKeys); ok {
+		return "statefulset"
+	}
+
+	namespace := object.GetNamespace()
+	sources := make([]string, 0, 2)
+
+	if namespaceMutationConfigAnnotation, ok := getNamespaceMutationConfigAnnotation(namespace, annotationKeys); ok {
+		sources = append(sources, describeMutationConfigValue(namespaceMutationConfigAnnotation, namespace, "namespace"))
+	}
+
+	if mutationConfigAnnotation, ok := object.GetAnnotations()[annotationKeys.Config]; ok {
+		sources = append(sources, describeMutationConfigValue(mutationConfigAnnotation, namespace, "annotation"))
+	}
+
+	return strings.Join(sources, " + ")
+}
+
+func isDryRun(admissionRequest *admissionv1.AdmissionRequest) bool {
+	return admissionRequest.DryRun != nil && *admissionRequest.DryRun
+}
+
+func getAllowedAdmissionResponse(admissionRequest *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		UID: admissionRequest.UID,
+		Allowed: true,
+	}
+}
+
+// policy violations are reported as forbidden, any other error means the
+// object itself is invalid
+func getDeniedAdmissionResponse(admissionRequest *admissionv1.AdmissionRequest, err error) *admissionv1.AdmissionResponse {
+	status := &metav1.Status{
+		Status: metav1.StatusFailure,
+		Code: http.StatusBadRequest,
+		Reason: metav1.StatusReasonBadRequest,
+		Message: err.Error(),
+	}
+
+	if _, ok := err.(*PolicyError); ok {
+		status.Code = http.StatusForbidden
+		status.Reason = metav1.StatusReasonForbidden
+	}
+
+	return &admissionv1.AdmissionResponse{
+		UID: admissionRequest.UID,
+		Allowed: false,
+		Result: status,
+	}
+}
+
+// with the Ignore policy objects with a broken config are admitted as they are
+func getConfigErrorAdmissionResponse(admissionRequest *admissionv1.AdmissionRequest, err error, configErrorPolicy string) *admissionv1.AdmissionResponse {
+	if configErrorPolicy == configErrorPolicyIgnore {
+		admissionResponse := getAllowedAdmissionResponse(admissionRequest)
+		admissionResponse.Warnings = []string{err.Error()}
+		return admissionResponse
+	}
+
+	return getDeniedAdmissionResponse(admissionRequest, err)
 }
 
 func getStatefulsetPodIndex(pod *corev1.Pod) (int, error) {
@@ -95,109 +253,171 @@ func getStatefulsetPodIndex(pod *corev1.Pod) (int, error) {
 	return num, nil
 }
 
-func getPodPatch(pod *corev1.Pod, mutationConfig map[string][]string) ([]map[string]interface{}, error) {
+// getPodPlacement returns the value each node label in the config takes for
+// the ordinal of the pod
+func getPodPlacement(pod *corev1.Pod, mutationConfig map[string][]string) (map[string]string, error) {
 	podIndex, err := getStatefulsetPodIndex(pod)
 	if err != nil {
 		return nil, err
 	}
 
-	patches := make([]map[string]interface{}, 0, 5)
+	placement := make(map[string]string, len(mutationConfig))
+	for key, vals := range mutationConfig {
+		placement[key] = vals[podIndex % len(vals)]
+	}
+
+	return placement, nil
+}
+
+func getSortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// injectPodAffinity adds a node selector term requiring the node label values
+// of the ordinal of the pod, unless the pod already has one
+func injectPodAffinity(pod *corev1.Pod, mutationConfig map[string][]string) error {
+	placement, err := getPodPlacement(pod, mutationConfig)
+	if err != nil {
+		return err
+	}
+
 	if pod.Spec.Affinity == nil {
 		pod.Spec.Affinity = &corev1.Affinity{}
-		patch := map[string]interface{}{
-			"op": "add",
-			"path": "/spec/affinity",
-			"value": map[string]interface{}{},
-		}
-		patches = append(patches, patch)
 	}
 
 	if pod.Spec.Affinity.NodeAffinity == nil {
 		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
-		patch := map[string]interface{}{
-			"op": "add",
-			"path": "/spec/affinity/nodeAffinity",
-			"value": map[string]interface{}{},
-		}
-		patches = append(patches, patch)
 	}
 
 	if pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
 		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
-		patch := map[string]interface{}{
-			"op": "add",
-			"path": "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution",
-			"value": map[string]interface{}{},
-		}
-		patches = append(patches, patch)
-	}
-
-	if pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms == nil {
-		patch := map[string]interface{}{
-			"op": "add",
-			"path": "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms",
-			"value": make([]corev1.NodeSelectorTerm, 0, 0),
-
-		}
-
-		patches = append(patches, patch)
 	}
 
-	expressions := make([]corev1.NodeSelectorRequirement, 0, len(mutationConfig))
-	for key, vals := range mutationConfig {
+	// sorted so the same pod always gets the same patch
+	expressions := make([]corev1.NodeSelectorRequirement, 0, len(placement))
+	for _, key := range getSortedKeys(placement) {
 		expressions = append(expressions, corev1.NodeSelectorRequirement{
 			Key: key,
 			Operator: "In",
-			Values: []string{ vals[podIndex % len(vals)] },
+			Values: []string{ placement[key] },
 		})
 	}
 
-	nodeSelectorTerm := corev1.NodeSelectorTerm{
+	nodeSelector := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+
+	// the webhook may be invoked again for the same pod, which must not add
+	// the term a second time
+	for _, term := range nodeSelector.NodeSelectorTerms {
+		if nodeSelectorTermRequires(term, placement) {
+			return nil
+		}
+	}
+
+	nodeSelector.NodeSelectorTerms = append(nodeSelector.NodeSelectorTerms, corev1.NodeSelectorTerm{
 		MatchExpressions: expressions,
+	})
+
+	return nil
+}
+
+// getPodPatch injects the affinity into a copy of the pod and returns the
+// json patch from the pod to the copy
+func getPodPatch(pod *corev1.Pod, mutationConfig map[string][]string) ([]map[string]interface{}, error) {
+	mutatedPod := pod.DeepCopy()
+	if err := injectPodAffinity(mutatedPod, mutationConfig); err != nil {
+		return nil, err
 	}
 
-	patch := map[string]interface{}{
-		"op": "add",
-		"path": "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/-",
-		"value": nodeSelectorTerm,
+	return getJSONPatch(pod, mutatedPod)
+}
+
+// the hash changes whenever the resolved config changes, even if the config
+// annotation itself does not, e.g. when a referenced ConfigMap is edited
+func getMutationConfigHash(mutationConfig map[string][]string) (string, error) {
+	mutationConfigBytes, err := json.Marshal(mutationConfig)
+	if err != nil {
+		return "", fmt.Errorf("Could not marshal mutation config into bytes -- possible formatting error: %v", err)
 	}
 
-	patches = append(patches, patch)
+	hash := sha256.Sum256(mutationConfigBytes)
+	return hex.EncodeToString(hash[:])[:16], nil
+}
 
-	return patches, nil
+// getMutationAuditAnnotations returns the audit annotations every mutation
+// carries, the api server prefixes their keys with the name of the webhook
+func getMutationAuditAnnotations(object K8sObject, mutationConfig map[string][]string, annotationKeys AnnotationKeys) (map[string]string, error) {
+	mutationConfigHash, err := getMutationConfigHash(mutationConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"config-source": getMutationConfigSource(object, annotationKeys),
+		"config-hash": mutationConfigHash,
+	}, nil
 }
 
-func getStatefulSetPatch(statefulSet *appsv1.StatefulSet) []map[string]interface{} {
-	patches := make([]map[string]interface{}, 0, 5)
+// injectStatefulSetAnnotations copies the opt-in and the resolved config of
+// the statefulset to its pod template, along with the hash of the config
+func injectStatefulSetAnnotations(statefulSet *appsv1.StatefulSet, mutationConfig map[string][]string, annotationKeys AnnotationKeys) error {
+	template := &statefulSet.Spec.Template
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[annotationKeys.Enabled] = "true"
 
-	//spec.template.metadata already exists since
-	//spec.template.metadata.label is required
-	if statefulSet.Spec.Template.Annotations == nil {
-		patch := map[string]interface{}{
-			"op": "add",
-			"path": "/spec/template/metadata/annotations",
-			"value": map[string]interface{}{},
+	// the pods need the label too when the webhook filters on it
+	if labelEnabled, _ := strconv.ParseBool(statefulSet.Labels[annotationKeys.Enabled]); labelEnabled {
+		if template.Labels == nil {
+			template.Labels = map[string]string{}
 		}
-		patches = append(patches, patch)
+		template.Labels[annotationKeys.Enabled] = "true"
+	}
+
+	// the resolved config is copied instead of the annotation, so a namespace
+	// default or a referenced configmap only changes the placement of new pods
+	// once the statefulset is applied again and rolls out its pods
+	mutationConfigBytes, err := json.Marshal(mutationConfig)
+	if err != nil {
+		return fmt.Errorf("Could not marshal mutation config into bytes -- possible formatting error: %v", err)
 	}
+	template.Annotations[annotationKeys.Config] = string(mutationConfigBytes)
+
+	// the statefulset is admitted now, so what it would have been denied
+	// for in shadow mode no longer applies
+	delete(statefulSet.Annotations, annotationKeys.ShadowResult)
 
-	//How to espace in jsonpatch
-	//https://jsonpatch.com/#json-pointer
-	patch := map[string]interface{}{
-		"op": "add",
-		"path": "/spec/template/metadata/annotations/statefulset-affinity-injector-webhook.hsiam261.github.io~1enabled",
-		"value": "true",
+	// statefulsets in shadow mode are not patched, so the pods of a patched
+	// statefulset are not in shadow mode either
+	delete(template.Annotations, annotationKeys.Shadow)
+
+	mutationConfigHash, err := getMutationConfigHash(mutationConfig)
+	if err != nil {
+		return err
 	}
+	template.Annotations[annotationKeys.ConfigHash] = mutationConfigHash
 
-	patches = append(patches, patch)
+	return nil
+}
 
-	patch = map[string]interface{}{
-		"op": "add",
-		"path": "/spec/template/metadata/annotations/statefulset-affinity-injector-webhook.hsiam261.github.io~1config",
-		"value": statefulSet.Annotations["statefulset-affinity-injector-webhook.hsiam261.github.io/config"],
+// getStatefulSetPatch injects the annotations into a copy of the statefulset
+// and returns the json patch from the statefulset to the copy
+func getStatefulSetPatch(statefulSet *appsv1.StatefulSet, mutationConfig map[string][]string, annotationKeys AnnotationKeys) ([]map[string]interface{}, error) {
+	mutatedStatefulSet := statefulSet.DeepCopy()
+	if err := injectStatefulSetAnnotations(mutatedStatefulSet, mutationConfig, annotationKeys); err != nil {
+		return nil, err
 	}
 
-	patches = append(patches, patch)
+	return getJSONPatch(statefulSet, mutatedStatefulSet)
+}
 
-	return patches
+// escapeJSONPointer escapes a json pointer token, see
+// https://jsonpatch.com/#json-pointer
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
 }